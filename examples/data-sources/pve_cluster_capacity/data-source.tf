@@ -0,0 +1,5 @@
+data "pve_cluster_capacity" "cluster" {}
+
+output "free_memory" {
+  value = data.pve_cluster_capacity.cluster.memory_free
+}
@@ -0,0 +1,5 @@
+data "pve_version" "current" {}
+
+output "release" {
+  value = data.pve_version.current.release
+}
@@ -0,0 +1,8 @@
+data "pve_vm_rrd" "web" {
+  vmid      = 100
+  timeframe = "hour"
+}
+
+output "cpu_average" {
+  value = data.pve_vm_rrd.web.cpu_average
+}
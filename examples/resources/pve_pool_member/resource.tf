@@ -0,0 +1,4 @@
+resource "pve_pool_member" "vm1" {
+  poolid = "team-a"
+  vmid   = pve_vm.vm1.id
+}
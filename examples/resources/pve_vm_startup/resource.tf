@@ -0,0 +1,11 @@
+# start the database before the app servers when the node boots
+resource "pve_vm_startup" "boot" {
+  dependency {
+    before = pve_vm.db.id
+    after  = pve_vm.app1.id
+  }
+  dependency {
+    before = pve_vm.db.id
+    after  = pve_vm.app2.id
+  }
+}
@@ -0,0 +1,104 @@
+package provider
+
+import (
+	"context"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+func dataSourceClusterCapacity() *schema.Resource {
+	return &schema.Resource{
+		Description: "Aggregate CPU and memory capacity of all online nodes in the cluster.",
+
+		ReadContext: dataSourceClusterCapacityRead,
+
+		Schema: map[string]*schema.Schema{
+			"nodes": {
+				Description: "Number of online nodes included in the totals.",
+				Type:        schema.TypeInt,
+				Computed:    true,
+			},
+			"cpu_total": {
+				Description: "Total number of cpu cores.",
+				Type:        schema.TypeInt,
+				Computed:    true,
+			},
+			"cpu_used": {
+				Description: "Number of cpu cores currently in use.",
+				Type:        schema.TypeFloat,
+				Computed:    true,
+			},
+			"cpu_free": {
+				Description: "Number of cpu cores currently idle.",
+				Type:        schema.TypeFloat,
+				Computed:    true,
+			},
+			"memory_total": {
+				Description: "Total memory size in Megabyte.",
+				Type:        schema.TypeInt,
+				Computed:    true,
+			},
+			"memory_used": {
+				Description: "Used memory size in Megabyte.",
+				Type:        schema.TypeInt,
+				Computed:    true,
+			},
+			"memory_free": {
+				Description: "Free memory size in Megabyte.",
+				Type:        schema.TypeInt,
+				Computed:    true,
+			},
+		},
+	}
+}
+
+func dataSourceClusterCapacityRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*apiClient)
+
+	var data map[string]interface{}
+	if err := client.GetJsonRetryable("/cluster/resources?type=node", &data, 3); err != nil {
+		return diag.Errorf("failed to list cluster nodes: %s", err)
+	}
+
+	nodes, ok := data["data"].([]interface{})
+	if !ok {
+		return diag.Errorf("unexpected response when listing cluster nodes")
+	}
+
+	var (
+		count       int
+		cpuTotal    float64
+		cpuUsed     float64
+		memoryTotal float64
+		memoryUsed  float64
+	)
+	for _, n := range nodes {
+		node, ok := n.(map[string]interface{})
+		if !ok || node["status"] != "online" {
+			continue
+		}
+		maxcpu, _ := node["maxcpu"].(float64)
+		cpu, _ := node["cpu"].(float64)
+		maxmem, _ := node["maxmem"].(float64)
+		mem, _ := node["mem"].(float64)
+
+		count++
+		cpuTotal += maxcpu
+		// cpu is reported as a utilization ratio of maxcpu
+		cpuUsed += cpu * maxcpu
+		memoryTotal += maxmem
+		memoryUsed += mem
+	}
+
+	d.SetId("cluster")
+	d.Set("nodes", count)
+	d.Set("cpu_total", int(cpuTotal))
+	d.Set("cpu_used", cpuUsed)
+	d.Set("cpu_free", cpuTotal-cpuUsed)
+	d.Set("memory_total", int(memoryTotal/1024/1024))
+	d.Set("memory_used", int(memoryUsed/1024/1024))
+	d.Set("memory_free", int((memoryTotal-memoryUsed)/1024/1024))
+
+	return nil
+}
@@ -0,0 +1,27 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
+)
+
+func TestAccDataSourceClusterCapacity(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+				data "pve_cluster_capacity" "cluster" {}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttrSet("data.pve_cluster_capacity.cluster", "cpu_total"),
+					resource.TestCheckResourceAttrSet("data.pve_cluster_capacity.cluster", "cpu_free"),
+					resource.TestCheckResourceAttrSet("data.pve_cluster_capacity.cluster", "memory_total"),
+					resource.TestCheckResourceAttrSet("data.pve_cluster_capacity.cluster", "memory_free"),
+				),
+			},
+		},
+	})
+}
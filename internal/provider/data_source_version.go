@@ -0,0 +1,58 @@
+package provider
+
+import (
+	"context"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+func dataSourceVersion() *schema.Resource {
+	return &schema.Resource{
+		Description: "Version of pve running on the cluster.",
+
+		ReadContext: dataSourceVersionRead,
+
+		Schema: map[string]*schema.Schema{
+			"version": {
+				Description: "Full version, eg. `7.1-10`.",
+				Type:        schema.TypeString,
+				Computed:    true,
+			},
+			"release": {
+				Description: "Release, eg. `7.1`.",
+				Type:        schema.TypeString,
+				Computed:    true,
+			},
+			"repoid": {
+				Description: "Source repository id of the build.",
+				Type:        schema.TypeString,
+				Computed:    true,
+			},
+		},
+	}
+}
+
+func dataSourceVersionRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*apiClient)
+
+	resp, err := client.GetVersion()
+	if err != nil {
+		return diag.Errorf("failed to get pve version: %s", err)
+	}
+	data, ok := resp["data"].(map[string]interface{})
+	if !ok {
+		return diag.Errorf("unexpected response when getting pve version")
+	}
+
+	version, _ := data["version"].(string)
+	release, _ := data["release"].(string)
+	repoid, _ := data["repoid"].(string)
+
+	d.SetId(version)
+	d.Set("version", version)
+	d.Set("release", release)
+	d.Set("repoid", repoid)
+
+	return nil
+}
@@ -0,0 +1,26 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
+)
+
+func TestAccDataSourceVersion(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+				data "pve_version" "current" {}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttrSet("data.pve_version.current", "version"),
+					resource.TestCheckResourceAttrSet("data.pve_version.current", "release"),
+					resource.TestCheckResourceAttrSet("data.pve_version.current", "repoid"),
+				),
+			},
+		},
+	})
+}
@@ -0,0 +1,176 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+)
+
+func dataSourceVMRRD() *schema.Resource {
+	return &schema.Resource{
+		Description: "Recent performance metrics of a vm, from the RRD data collected by pve.",
+
+		ReadContext: dataSourceVMRRDRead,
+
+		Schema: map[string]*schema.Schema{
+			"vmid": {
+				Description: "ID of the vm.",
+				Type:        schema.TypeInt,
+				Required:    true,
+			},
+			"timeframe": {
+				Description:  "Time range of the data series, one of `hour`, `day` or `week`.",
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "hour",
+				ValidateFunc: validation.StringInSlice([]string{"hour", "day", "week"}, false),
+			},
+			"cpu_latest": {
+				Description: "Latest cpu usage, as a ratio of the cores of the vm.",
+				Type:        schema.TypeFloat,
+				Computed:    true,
+			},
+			"cpu_average": {
+				Description: "Average cpu usage over the timeframe, as a ratio of the cores of the vm.",
+				Type:        schema.TypeFloat,
+				Computed:    true,
+			},
+			"memory_latest": {
+				Description: "Latest used memory size in Megabyte.",
+				Type:        schema.TypeFloat,
+				Computed:    true,
+			},
+			"memory_average": {
+				Description: "Average used memory size over the timeframe in Megabyte.",
+				Type:        schema.TypeFloat,
+				Computed:    true,
+			},
+			"data": {
+				Description: "Data series, one entry per point in time. Points collected while the vm was not running only carry `time`.",
+				Type:        schema.TypeList,
+				Computed:    true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"time": {
+							Type:     schema.TypeInt,
+							Computed: true,
+						},
+						"cpu": {
+							Type:     schema.TypeFloat,
+							Computed: true,
+						},
+						"memory_used": {
+							Type:     schema.TypeFloat,
+							Computed: true,
+						},
+						"memory_total": {
+							Type:     schema.TypeFloat,
+							Computed: true,
+						},
+						"net_in": {
+							Type:     schema.TypeFloat,
+							Computed: true,
+						},
+						"net_out": {
+							Type:     schema.TypeFloat,
+							Computed: true,
+						},
+						"disk_read": {
+							Type:     schema.TypeFloat,
+							Computed: true,
+						},
+						"disk_write": {
+							Type:     schema.TypeFloat,
+							Computed: true,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func dataSourceVMRRDRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*apiClient)
+
+	vmid := d.Get("vmid").(int)
+	timeframe := d.Get("timeframe").(string)
+
+	node, err := client.resolveNode(vmid)
+	if err != nil {
+		return diag.Errorf("failed to resolve node: %s", err)
+	}
+
+	var resp map[string]interface{}
+	url := fmt.Sprintf("/nodes/%s/qemu/%d/rrddata?timeframe=%s", node, vmid, timeframe)
+	if err := client.GetJsonRetryable(url, &resp, 3); err != nil {
+		return diag.Errorf("failed to get rrd data: %s", err)
+	}
+
+	points, ok := resp["data"].([]interface{})
+	if !ok {
+		return diag.Errorf("unexpected response when getting rrd data")
+	}
+
+	var (
+		data        []interface{}
+		count       int
+		cpuLatest   float64
+		cpuSum      float64
+		memLatest   float64
+		memSum      float64
+		megabyte    = float64(1024 * 1024)
+		fieldsBytes = map[string]string{"memory_used": "mem", "memory_total": "maxmem"}
+		fieldsRate  = map[string]string{"net_in": "netin", "net_out": "netout", "disk_read": "diskread", "disk_write": "diskwrite"}
+	)
+	for _, p := range points {
+		point, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		t, _ := point["time"].(float64)
+		m := map[string]interface{}{"time": int(t)}
+		if cpu, ok := point["cpu"].(float64); ok {
+			m["cpu"] = cpu
+		}
+		for k, n := range fieldsBytes {
+			if v, ok := point[n].(float64); ok {
+				m[k] = v / megabyte
+			}
+		}
+		for k, n := range fieldsRate {
+			if v, ok := point[n].(float64); ok {
+				m[k] = v
+			}
+		}
+		data = append(data, m)
+
+		// points without samples, eg. the vm was stopped, don't count
+		cpu, ok := m["cpu"].(float64)
+		if !ok {
+			continue
+		}
+		mem, _ := m["memory_used"].(float64)
+		count++
+		cpuLatest, cpuSum = cpu, cpuSum+cpu
+		memLatest, memSum = mem, memSum+mem
+	}
+
+	d.SetId(strconv.Itoa(vmid))
+	d.Set("data", data)
+	d.Set("cpu_latest", cpuLatest)
+	d.Set("memory_latest", memLatest)
+	if count > 0 {
+		d.Set("cpu_average", cpuSum/float64(count))
+		d.Set("memory_average", memSum/float64(count))
+	} else {
+		d.Set("cpu_average", 0)
+		d.Set("memory_average", 0)
+	}
+
+	return nil
+}
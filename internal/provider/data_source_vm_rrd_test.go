@@ -0,0 +1,38 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
+)
+
+func TestAccDataSourceVMRRD(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-rrd"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+				}
+
+				data "pve_vm_rrd" "vm1" {
+					vmid = pve_vm.vm1.id
+					timeframe = "hour"
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttrSet("data.pve_vm_rrd.vm1", "data.#"),
+					resource.TestCheckResourceAttrSet("data.pve_vm_rrd.vm1", "cpu_average"),
+					resource.TestCheckResourceAttrSet("data.pve_vm_rrd.vm1", "memory_average"),
+				),
+			},
+		},
+	})
+}
@@ -0,0 +1,78 @@
+package provider
+
+import "strings"
+
+type property struct {
+	key   string
+	value string
+}
+
+// propertyList is a parsed pve property string, eg. "host,flags=+aes;+pdpe1gb".
+// Order of properties is preserved so unmanaged options round-trip unchanged.
+type propertyList struct {
+	defaultKey string
+	props      []property
+}
+
+// parsePropertyList parses a pve property string. A value without key is stored under
+// defaultKey, like the cpu type in "host,flags=+aes".
+func parsePropertyList(s, defaultKey string) *propertyList {
+	l := &propertyList{defaultKey: defaultKey}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if k, v, ok := strings.Cut(part, "="); ok {
+			l.props = append(l.props, property{k, v})
+		} else {
+			l.props = append(l.props, property{defaultKey, part})
+		}
+	}
+	return l
+}
+
+func (l *propertyList) Get(key string) (string, bool) {
+	for _, p := range l.props {
+		if p.key == key {
+			return p.value, true
+		}
+	}
+	return "", false
+}
+
+func (l *propertyList) Set(key, value string) {
+	for i, p := range l.props {
+		if p.key == key {
+			l.props[i].value = value
+			return
+		}
+	}
+	if key == l.defaultKey {
+		l.props = append([]property{{key, value}}, l.props...)
+		return
+	}
+	l.props = append(l.props, property{key, value})
+}
+
+func (l *propertyList) Delete(key string) {
+	props := l.props[:0]
+	for _, p := range l.props {
+		if p.key != key {
+			props = append(props, p)
+		}
+	}
+	l.props = props
+}
+
+func (l *propertyList) String() string {
+	parts := make([]string, 0, len(l.props))
+	for i, p := range l.props {
+		if i == 0 && p.key == l.defaultKey {
+			parts = append(parts, p.value)
+		} else {
+			parts = append(parts, p.key+"="+p.value)
+		}
+	}
+	return strings.Join(parts, ",")
+}
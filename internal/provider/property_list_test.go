@@ -0,0 +1,45 @@
+package provider
+
+import "testing"
+
+func TestPropertyList(t *testing.T) {
+	cases := []struct {
+		in      string
+		key     string
+		value   string
+		present bool
+		out     string
+	}{
+		{in: "host", key: "cputype", value: "host", present: true, out: "host"},
+		{in: "cputype=host,flags=+aes", key: "flags", value: "+aes", present: true, out: "host,flags=+aes"},
+		{in: "virtio=AA:BB:CC:DD:EE:FF,bridge=vmbr0", key: "firewall", present: false, out: "virtio=AA:BB:CC:DD:EE:FF,bridge=vmbr0"},
+		{in: "", key: "cputype", present: false, out: ""},
+	}
+
+	for _, c := range cases {
+		l := parsePropertyList(c.in, "cputype")
+		value, present := l.Get(c.key)
+		if present != c.present || value != c.value {
+			t.Errorf("parsePropertyList(%q).Get(%q) = %q, %v; want %q, %v", c.in, c.key, value, present, c.value, c.present)
+		}
+		if out := l.String(); out != c.out {
+			t.Errorf("parsePropertyList(%q).String() = %q; want %q", c.in, out, c.out)
+		}
+	}
+}
+
+func TestPropertyListSetDelete(t *testing.T) {
+	l := parsePropertyList("flags=+aes", "cputype")
+	l.Set("cputype", "host")
+	if out := l.String(); out != "host,flags=+aes" {
+		t.Errorf("after Set cputype, got %q", out)
+	}
+	l.Set("flags", "+aes;-spec-ctrl")
+	if out := l.String(); out != "host,flags=+aes;-spec-ctrl" {
+		t.Errorf("after Set flags, got %q", out)
+	}
+	l.Delete("flags")
+	if out := l.String(); out != "host" {
+		t.Errorf("after Delete flags, got %q", out)
+	}
+}
@@ -5,11 +5,17 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	pxapi "github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
 )
 
 func init() {
@@ -38,16 +44,31 @@ func New(version string) func() *schema.Provider {
 					DefaultFunc: schema.EnvDefaultFunc("PVE_ENDPOINT", nil),
 				},
 				"username": {
+					Description: "Required unless `api_token_id` is set.",
 					Type:        schema.TypeString,
-					Required:    true,
+					Optional:    true,
 					DefaultFunc: schema.EnvDefaultFunc("PVE_USERNAME", nil),
 				},
 				"password": {
+					Description: "Required unless `api_token_id` is set.",
 					Type:        schema.TypeString,
 					Sensitive:   true,
-					Required:    true,
+					Optional:    true,
 					DefaultFunc: schema.EnvDefaultFunc("PVE_PASSWORD", nil),
 				},
+				"api_token_id": {
+					Description: "ID of an API token to authenticate with instead of `username` and `password`, in the form `user@realm!tokenid`.",
+					Type:        schema.TypeString,
+					Optional:    true,
+					DefaultFunc: schema.EnvDefaultFunc("PVE_API_TOKEN_ID", nil),
+				},
+				"api_token_secret": {
+					Description: "Secret of the API token `api_token_id`.",
+					Type:        schema.TypeString,
+					Sensitive:   true,
+					Optional:    true,
+					DefaultFunc: schema.EnvDefaultFunc("PVE_API_TOKEN_SECRET", nil),
+				},
 				"otp": {
 					Type:      schema.TypeString,
 					Sensitive: true,
@@ -58,9 +79,43 @@ func New(version string) func() *schema.Provider {
 					Type:        schema.TypeBool,
 					Optional:    true,
 				},
+				"skip_ip_wait": {
+					Description: "Don't wait for the guest agent to report ip addresses after a vm is started, leaving `ipv4_address` empty until a later refresh. Speeds up creating many vms at once.",
+					Type:        schema.TypeBool,
+					Optional:    true,
+				},
+				"debug_commands": {
+					Description: "Log output and exit status of commands run in the node shell, like writing `user_data` snippets, at debug level (`TF_LOG=DEBUG`). The output may contain secrets of those commands.",
+					Type:        schema.TypeBool,
+					Optional:    true,
+				},
+				"max_clones_per_node": {
+					Description:  "Maximum number of vms cloned to a node at the same time, further clones wait for a slot. Full clones copying disks at once can saturate the storage of a node. `0` doesn't limit clones.",
+					Type:         schema.TypeInt,
+					Optional:     true,
+					Default:      0,
+					ValidateFunc: validation.IntAtLeast(0),
+				},
+				"management_tag": {
+					Description: "Tag added to every vm created by this provider, making terraform managed vms easy to find in pve. Set to empty string to disable.",
+					Type:        schema.TypeString,
+					Optional:    true,
+					Default:     "terraform",
+					ValidateFunc: validation.Any(
+						validation.StringIsEmpty,
+						validation.StringMatch(regexp.MustCompile(`^[a-z0-9_][a-z0-9_+.-]*$`), "not a valid pve tag"),
+					),
+				},
+			},
+			DataSourcesMap: map[string]*schema.Resource{
+				"pve_cluster_capacity": dataSourceClusterCapacity(),
+				"pve_vm_rrd":           dataSourceVMRRD(),
+				"pve_version":          dataSourceVersion(),
 			},
 			ResourcesMap: map[string]*schema.Resource{
-				"pve_vm": resourceVM(),
+				"pve_vm":          resourceVM(),
+				"pve_pool_member": resourcePoolMember(),
+				"pve_vm_startup":  resourceVMStartup(),
 			},
 		}
 
@@ -72,13 +127,232 @@ func New(version string) func() *schema.Provider {
 
 type apiClient struct {
 	*pxapi.Client
-	session *pxapi.Session
+
+	// session serves requests not covered by pxapi.Client, it is logged in on first use
+	sessionMu  sync.Mutex
+	session    *pxapi.Session
+	newSession func() (*pxapi.Session, error)
+
+	managementTag string
+	skipIPWait    bool
+	debugCommands bool
+
+	// endpoint is the url of the pve api without /api2/json, clients of the endpoints overridden
+	// by resources are kept in endpoints
+	endpoint    string
+	credentials apiCredentials
+	endpointMu  sync.Mutex
+	endpoints   map[string]*apiClient
+
+	// placements of vms created per anti affinity group, by vmid, counted along with the vms
+	// tagged with the group, which the vms created concurrently aren't yet
+	placementMu sync.Mutex
+	placements  map[string]map[int]string
+
+	// clone slots per target node, holding up to maxClonesPerNode tokens each
+	maxClonesPerNode int
+	cloneMu          sync.Mutex
+	cloneSlots       map[string]chan struct{}
+
+	// version of pve detected at configure, used to gate version specific features
+	versionMajor int
+	versionMinor int
+}
+
+// checkVersion returns an error naming feature when the cluster runs a pve older than major.minor.
+func (c *apiClient) checkVersion(major, minor int, feature string) error {
+	if c.versionMajor > major || (c.versionMajor == major && c.versionMinor >= minor) {
+		return nil
+	}
+	return fmt.Errorf("%s requires pve %d.%d or later, the cluster runs %d.%d", feature, major, minor, c.versionMajor, c.versionMinor)
+}
+
+// parseVersion parses major and minor out of a pve version, eg. "7.1-10" or "8.1.3".
+func parseVersion(version string) (major, minor int, err error) {
+	if _, err := fmt.Sscanf(version, "%d.%d", &major, &minor); err != nil {
+		return 0, 0, fmt.Errorf("unexpected pve version %q", version)
+	}
+	return major, minor, nil
+}
+
+func (c *apiClient) getSession() (*pxapi.Session, error) {
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+
+	if c.session == nil {
+		session, err := c.newSession()
+		if err != nil {
+			return nil, fmt.Errorf("failed to login session: %s", err)
+		}
+		c.session = session
+	}
+	return c.session, nil
+}
+
+// resolveNode returns the node where vm vmid currently sits, according to cluster resources.
+// Unlike vmref.Node(), it does not depend on a prior CheckVmRef and follows migrations.
+func (c *apiClient) resolveNode(vmid int) (string, error) {
+	list, err := c.GetVmList()
+	if err != nil {
+		return "", err
+	}
+	vms, _ := list["data"].([]interface{})
+	for _, vm := range vms {
+		vm, _ := vm.(map[string]interface{})
+		if id, ok := vm["vmid"].(float64); ok && int(id) == vmid {
+			if node, ok := vm["node"].(string); ok {
+				return node, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("vm '%d' not found", vmid)
+}
+
+// isVMNotFound reports whether err, returned by a request for vm vmid, means the vm is gone. A vm
+// deleted after CheckVmRef looked it up fails later requests with a 500 for its missing config.
+func isVMNotFound(err error, vmid int) bool {
+	msg := err.Error()
+	return msg == fmt.Sprintf("vm '%d' not found", vmid) || (strings.HasPrefix(msg, "500 ") && strings.Contains(msg, "does not exist"))
 }
 
 func (c *apiClient) moveQemuDisk(vmr *pxapi.VmRef, opts map[string]interface{}) (exitStatus interface{}, err error) {
+	session, err := c.getSession()
+	if err != nil {
+		return nil, err
+	}
+	node, err := c.resolveNode(vmr.VmId())
+	if err != nil {
+		return nil, err
+	}
+	reqbody := pxapi.ParamsToBody(opts)
+	url := fmt.Sprintf("/nodes/%s/qemu/%d/move_disk", node, vmr.VmId())
+	resp, err := session.Post(url, nil, nil, &reqbody)
+	if err == nil {
+		taskResponse, err := pxapi.ResponseJSON(resp)
+		if err != nil {
+			return nil, err
+		}
+		exitStatus, err = c.WaitForCompletion(taskResponse)
+	}
+	return
+}
+
+// postTask posts params to url and returns the upid of the task pve started for it, or "" when pve
+// completed the request right away.
+func (c *apiClient) postTask(url string, params map[string]interface{}) (string, error) {
+	session, err := c.getSession()
+	if err != nil {
+		return "", err
+	}
+	reqbody := pxapi.ParamsToBody(params)
+	resp, err := session.Post(url, nil, nil, &reqbody)
+	if err != nil {
+		return "", err
+	}
+	taskResponse, err := pxapi.ResponseJSON(resp)
+	if err != nil {
+		return "", err
+	}
+	upid, _ := taskResponse["data"].(string)
+	return upid, nil
+}
+
+// cloneQemuVm clones template tplref with params and waits up to timeout for the clone task to
+// finish. Unlike pxapi CloneQemuVm it reports a failed or unfinished clone task as error.
+func (c *apiClient) cloneQemuVm(ctx context.Context, tplref *pxapi.VmRef, params map[string]interface{}, timeout time.Duration) error {
+	upid, err := c.postTask(fmt.Sprintf("/nodes/%s/qemu/%d/clone", tplref.Node(), tplref.VmId()), params)
+	if err != nil {
+		return err
+	}
+	return waitForTask(ctx, c, tplref.Node(), upid, timeout)
+}
+
+// setVmConfig updates config of vm with params. Changes taking a while, eg. allocating a disk,
+// run as task, which it waits up to timeout for.
+func (c *apiClient) setVmConfig(ctx context.Context, vmref *pxapi.VmRef, params map[string]interface{}, timeout time.Duration) error {
+	upid, err := c.postTask(fmt.Sprintf("/nodes/%s/qemu/%d/config", vmref.Node(), vmref.VmId()), params)
+	if err != nil {
+		return err
+	}
+	return waitForTask(ctx, c, vmref.Node(), upid, timeout)
+}
+
+// waitForTask polls the status of task upid of node until it stopped, and returns an error unless
+// it stopped with OK. An empty upid is a request pve completed without task.
+func waitForTask(ctx context.Context, client *apiClient, node, upid string, timeout time.Duration) error {
+	if upid == "" {
+		return nil
+	}
+	session, err := client.getSession()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		var resp struct {
+			Data struct {
+				Status     string `json:"status"`
+				ExitStatus string `json:"exitstatus"`
+			} `json:"data"`
+		}
+		if _, err := session.GetJSON(fmt.Sprintf("/nodes/%s/tasks/%s/status", node, url.PathEscape(upid)), nil, nil, &resp); err != nil {
+			return fmt.Errorf("failed to get status of task %s: %s", upid, err)
+		}
+		if resp.Data.Status == "stopped" {
+			// a task that logged warnings still succeeded, eg. a clone or a disk move
+			if strings.HasPrefix(resp.Data.ExitStatus, "WARNINGS:") {
+				tflog.Warn(ctx, "task finished with warnings", map[string]interface{}{"upid": upid, "exitstatus": resp.Data.ExitStatus})
+				return nil
+			}
+			if resp.Data.ExitStatus != "OK" {
+				return fmt.Errorf("task %s failed: %s", upid, resp.Data.ExitStatus)
+			}
+			return nil
+		}
+
+		tflog.Trace(ctx, "task still running", map[string]interface{}{"upid": upid})
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("task %s didn't finish: %s", upid, ctx.Err())
+		case <-time.After(pollDuration):
+		}
+	}
+}
+
+// deleteVolume destroys volume volid through node and waits up to timeout for it.
+func (c *apiClient) deleteVolume(ctx context.Context, node, volid string, timeout time.Duration) error {
+	session, err := c.getSession()
+	if err != nil {
+		return err
+	}
+	storage, _, _ := strings.Cut(volid, ":")
+	resp, err := session.Delete(fmt.Sprintf("/nodes/%s/storage/%s/content/%s", node, storage, url.PathEscape(volid)), nil, nil)
+	if err != nil {
+		return err
+	}
+	taskResponse, err := pxapi.ResponseJSON(resp)
+	if err != nil {
+		return err
+	}
+	upid, _ := taskResponse["data"].(string)
+	return waitForTask(ctx, c, node, upid, timeout)
+}
+
+func (c *apiClient) shutdownVm(vmr *pxapi.VmRef, opts map[string]interface{}) (exitStatus interface{}, err error) {
+	session, err := c.getSession()
+	if err != nil {
+		return nil, err
+	}
+	node, err := c.resolveNode(vmr.VmId())
+	if err != nil {
+		return nil, err
+	}
 	reqbody := pxapi.ParamsToBody(opts)
-	url := fmt.Sprintf("/nodes/%s/%s/%d/move_disk", vmr.Node(), vmr.GetVmType(), vmr.VmId())
-	resp, err := c.session.Post(url, nil, nil, &reqbody)
+	url := fmt.Sprintf("/nodes/%s/qemu/%d/status/shutdown", node, vmr.VmId())
+	resp, err := session.Post(url, nil, nil, &reqbody)
 	if err == nil {
 		taskResponse, err := pxapi.ResponseJSON(resp)
 		if err != nil {
@@ -89,6 +363,304 @@ func (c *apiClient) moveQemuDisk(vmr *pxapi.VmRef, opts map[string]interface{})
 	return
 }
 
+// agentFileRead reads file inside the guest through the guest agent.
+func (c *apiClient) agentFileRead(vmr *pxapi.VmRef, file string) (string, error) {
+	session, err := c.getSession()
+	if err != nil {
+		return "", err
+	}
+	node, err := c.resolveNode(vmr.VmId())
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Data struct {
+			Content string `json:"content"`
+		} `json:"data"`
+	}
+	params := url.Values{"file": {file}}
+	path := fmt.Sprintf("/nodes/%s/qemu/%d/agent/file-read", node, vmr.VmId())
+	if _, err := session.GetJSON(path, &params, nil, &resp); err != nil {
+		return "", err
+	}
+	return resp.Data.Content, nil
+}
+
+type agentOSInfo struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	PrettyName    string `json:"pretty-name"`
+	Version       string `json:"version"`
+	VersionID     string `json:"version-id"`
+	KernelRelease string `json:"kernel-release"`
+	KernelVersion string `json:"kernel-version"`
+	Machine       string `json:"machine"`
+}
+
+// agentOSInfo returns the os info the guest agent reports.
+func (c *apiClient) agentOSInfo(vmr *pxapi.VmRef) (*agentOSInfo, error) {
+	session, err := c.getSession()
+	if err != nil {
+		return nil, err
+	}
+	node, err := c.resolveNode(vmr.VmId())
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Data struct {
+			Result agentOSInfo `json:"result"`
+		} `json:"data"`
+	}
+	path := fmt.Sprintf("/nodes/%s/qemu/%d/agent/get-osinfo", node, vmr.VmId())
+	if _, err := session.GetJSON(path, nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Data.Result, nil
+}
+
+// cloudInitDump returns the cloud-init config of kind, eg. "user", pve generates for vm.
+func (c *apiClient) cloudInitDump(vmr *pxapi.VmRef, kind string) (string, error) {
+	session, err := c.getSession()
+	if err != nil {
+		return "", err
+	}
+	node, err := c.resolveNode(vmr.VmId())
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Data string `json:"data"`
+	}
+	params := url.Values{"type": {kind}}
+	path := fmt.Sprintf("/nodes/%s/qemu/%d/cloudinit/dump", node, vmr.VmId())
+	if _, err := session.GetJSON(path, &params, nil, &resp); err != nil {
+		return "", err
+	}
+	return resp.Data, nil
+}
+
+// regenerateCloudInit rebuilds the cloud-init drive of vm from its current config and snippets.
+func (c *apiClient) regenerateCloudInit(vmr *pxapi.VmRef) error {
+	session, err := c.getSession()
+	if err != nil {
+		return err
+	}
+	node, err := c.resolveNode(vmr.VmId())
+	if err != nil {
+		return err
+	}
+	_, err = session.Put(fmt.Sprintf("/nodes/%s/qemu/%d/cloudinit", node, vmr.VmId()), nil, nil, nil)
+	return err
+}
+
+type storageConfig struct {
+	Type    string
+	Content []string
+	// Path is the directory of file based storages, eg. "/var/lib/vz" for local
+	Path string
+}
+
+// storageConfig returns the config of storage, from the storage config of the cluster.
+func (c *apiClient) storageConfig(storage string) (*storageConfig, error) {
+	session, err := c.getSession()
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Data struct {
+			Type    string `json:"type"`
+			Content string `json:"content"`
+			Path    string `json:"path"`
+		} `json:"data"`
+	}
+	if _, err := session.GetJSON("/storage/"+storage, nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &storageConfig{Type: resp.Data.Type, Content: strings.Split(resp.Data.Content, ","), Path: resp.Data.Path}, nil
+}
+
+// storageAvail returns the free space of storage on node in bytes.
+func (c *apiClient) storageAvail(node, storage string) (int64, error) {
+	session, err := c.getSession()
+	if err != nil {
+		return 0, err
+	}
+	var resp struct {
+		Data struct {
+			Avail int64 `json:"avail"`
+		} `json:"data"`
+	}
+	if _, err := session.GetJSON(fmt.Sprintf("/nodes/%s/storage/%s/status", node, storage), nil, nil, &resp); err != nil {
+		return 0, err
+	}
+	return resp.Data.Avail, nil
+}
+
+// listBridges returns names of the bridges of node and of the SDN vnets of the cluster, which a
+// nic can be attached to alike. Vnets are left out when SDN isn't available.
+func (c *apiClient) listBridges(node string) ([]string, error) {
+	session, err := c.getSession()
+	if err != nil {
+		return nil, err
+	}
+	var bridges struct {
+		Data []struct {
+			Iface string `json:"iface"`
+		} `json:"data"`
+	}
+	params := url.Values{"type": {"any_bridge"}}
+	if _, err := session.GetJSON(fmt.Sprintf("/nodes/%s/network", node), &params, nil, &bridges); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(bridges.Data))
+	for _, b := range bridges.Data {
+		names = append(names, b.Iface)
+	}
+
+	var vnets struct {
+		Data []struct {
+			Vnet string `json:"vnet"`
+		} `json:"data"`
+	}
+	// fails on clusters without SDN and for accounts without SDN.Audit
+	if _, err := session.GetJSON("/cluster/sdn/vnets", nil, nil, &vnets); err == nil {
+		for _, v := range vnets.Data {
+			names = append(names, v.Vnet)
+		}
+	}
+	return names, nil
+}
+
+// listMdevTypes returns the mediated device types pci device host of node offers. A device
+// without support for mediated devices offers none.
+func (c *apiClient) listMdevTypes(node, host string) ([]string, error) {
+	session, err := c.getSession()
+	if err != nil {
+		return nil, err
+	}
+	// pve lists mdev types of a single function, in the full form of the address
+	if strings.Count(host, ":") == 1 {
+		host = "0000:" + host
+	}
+	if !strings.Contains(host, ".") {
+		host += ".0"
+	}
+	var resp struct {
+		Data []struct {
+			Type string `json:"type"`
+		} `json:"data"`
+	}
+	if _, err := session.GetJSON(fmt.Sprintf("/nodes/%s/hardware/pci/%s/mdev", node, host), nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	types := make([]string, 0, len(resp.Data))
+	for _, t := range resp.Data {
+		types = append(types, t.Type)
+	}
+	return types, nil
+}
+
+// listPools returns ids of the resource pools the account can see.
+func (c *apiClient) listPools() ([]string, error) {
+	session, err := c.getSession()
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Data []struct {
+			PoolID string `json:"poolid"`
+		} `json:"data"`
+	}
+	if _, err := session.GetJSON("/pools", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	pools := make([]string, 0, len(resp.Data))
+	for _, p := range resp.Data {
+		pools = append(pools, p.PoolID)
+	}
+	return pools, nil
+}
+
+// moveToPool moves vm vmid out of pool from into pool to, either may be empty. Unlike pxapi
+// UpdateVMPool it reports a failed request.
+func (c *apiClient) moveToPool(vmid int, from, to string) error {
+	if from == to {
+		return nil
+	}
+	session, err := c.getSession()
+	if err != nil {
+		return err
+	}
+	if from != "" {
+		reqbody := pxapi.ParamsToBody(map[string]interface{}{"vms": vmid, "delete": 1})
+		if _, err := session.Put("/pools/"+url.PathEscape(from), nil, nil, &reqbody); err != nil {
+			return fmt.Errorf("failed to remove vm from pool %s: %s", from, err)
+		}
+	}
+	if to != "" {
+		reqbody := pxapi.ParamsToBody(map[string]interface{}{"vms": vmid})
+		if _, err := session.Put("/pools/"+url.PathEscape(to), nil, nil, &reqbody); err != nil {
+			return fmt.Errorf("failed to add vm into pool %s: %s", to, err)
+		}
+	}
+	return nil
+}
+
+// aclEntry grants the user, group or api token id the role on an acl path.
+type aclEntry struct {
+	// Type is one of "user", "group" or "token"
+	Type string
+	ID   string
+	Role string
+}
+
+// listACL returns the acl entries set on path itself, entries inherited from parent paths are
+// left out.
+func (c *apiClient) listACL(path string) ([]aclEntry, error) {
+	session, err := c.getSession()
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Data []struct {
+			Path   string `json:"path"`
+			Type   string `json:"type"`
+			UGID   string `json:"ugid"`
+			RoleID string `json:"roleid"`
+		} `json:"data"`
+	}
+	if _, err := session.GetJSON("/access/acl", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	entries := []aclEntry{}
+	for _, e := range resp.Data {
+		if e.Path == path {
+			entries = append(entries, aclEntry{Type: e.Type, ID: e.UGID, Role: e.RoleID})
+		}
+	}
+	return entries, nil
+}
+
+// updateACL grants the role of entry on path, or revokes it when remove is set.
+func (c *apiClient) updateACL(path string, entry aclEntry, remove bool) error {
+	session, err := c.getSession()
+	if err != nil {
+		return err
+	}
+	params := map[string]interface{}{
+		"path":           path,
+		"roles":          entry.Role,
+		entry.Type + "s": entry.ID,
+	}
+	if remove {
+		params["delete"] = 1
+	}
+	reqbody := pxapi.ParamsToBody(params)
+	_, err = session.Put("/access/acl", nil, nil, &reqbody)
+	return err
+}
+
 func configure(version string, p *schema.Provider) func(context.Context, *schema.ResourceData) (interface{}, diag.Diagnostics) {
 	return func(ctx context.Context, d *schema.ResourceData) (interface{}, diag.Diagnostics) {
 		endpoint := d.Get("endpoint").(string)
@@ -98,32 +670,170 @@ func configure(version string, p *schema.Provider) func(context.Context, *schema
 		if v, ok := d.GetOk("otp"); ok {
 			otp = v.(string)
 		}
-
-		apiUrl := strings.TrimRight(endpoint, "/") + "/api2/json"
-
-		httpClient := &http.Client{}
-
-		var tlsConfig *tls.Config
-		if insecure, ok := d.GetOk("insecure"); ok && insecure == true {
-			tlsConfig = &tls.Config{InsecureSkipVerify: true}
+		tokenID := d.Get("api_token_id").(string)
+		tokenSecret := d.Get("api_token_secret").(string)
+		if (tokenID != "") != (tokenSecret != "") {
+			return nil, diag.Errorf("api_token_id and api_token_secret must be set together")
 		}
-
-		client, err := pxapi.NewClient(apiUrl, httpClient, tlsConfig, "", 300)
-		if err != nil {
-			return nil, diag.FromErr(err)
-		}
-		if err := client.Login(username, password, otp); err != nil {
-			return nil, diag.FromErr(err)
+		if tokenID == "" && (username == "" || password == "") {
+			return nil, diag.Errorf("username and password are required unless api_token_id and api_token_secret are set")
 		}
 
-		session, err := pxapi.NewSession(apiUrl, httpClient, "", tlsConfig)
+		credentials := apiCredentials{
+			username:    username,
+			password:    password,
+			otp:         otp,
+			tokenID:     tokenID,
+			tokenSecret: tokenSecret,
+			insecure:    d.Get("insecure").(bool),
+		}
+		c, err := newAPIClient(endpoint, credentials)
 		if err != nil {
 			return nil, diag.FromErr(err)
 		}
-		if err := session.Login(username, password, otp); err != nil {
-			return nil, diag.FromErr(err)
+		c.managementTag = d.Get("management_tag").(string)
+		c.skipIPWait = d.Get("skip_ip_wait").(bool)
+		c.debugCommands = d.Get("debug_commands").(bool)
+		c.maxClonesPerNode = d.Get("max_clones_per_node").(int)
+
+		// an otp can't be used again later, so login the session now
+		if otp != "" && !credentials.useToken() {
+			if _, err := c.getSession(); err != nil {
+				return nil, diag.FromErr(err)
+			}
 		}
 
-		return &apiClient{client, session}, nil
+		return c, nil
+	}
+}
+
+// apiCredentials are the credentials the provider is configured with, kept to login to the
+// endpoints of resources alike.
+type apiCredentials struct {
+	username    string
+	password    string
+	otp         string
+	tokenID     string
+	tokenSecret string
+	insecure    bool
+}
+
+func (c apiCredentials) useToken() bool {
+	return c.tokenID != ""
+}
+
+// newAPIClient logs in to the pve api at endpoint and detects the version of pve it runs.
+func newAPIClient(endpoint string, credentials apiCredentials) (*apiClient, error) {
+	endpoint = strings.TrimRight(endpoint, "/")
+	apiUrl := endpoint + "/api2/json"
+
+	httpClient := &http.Client{}
+
+	var tlsConfig *tls.Config
+	if credentials.insecure {
+		tlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	client, err := pxapi.NewClient(apiUrl, httpClient, tlsConfig, "", 300)
+	if err != nil {
+		return nil, err
+	}
+	if credentials.useToken() {
+		client.SetAPIToken(credentials.tokenID, credentials.tokenSecret)
+	} else if err := client.Login(credentials.username, credentials.password, credentials.otp); err != nil {
+		return nil, err
+	}
+
+	versionResp, err := client.GetVersion()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pve version: %s", err)
+	}
+	versionData, _ := versionResp["data"].(map[string]interface{})
+	version, _ := versionData["version"].(string)
+	major, minor, err := parseVersion(version)
+	if err != nil {
+		return nil, err
+	}
+
+	return &apiClient{
+		Client: client,
+		newSession: func() (*pxapi.Session, error) {
+			session, err := pxapi.NewSession(apiUrl, httpClient, "", tlsConfig)
+			if err != nil {
+				return nil, err
+			}
+			if credentials.useToken() {
+				session.SetAPIToken(credentials.tokenID, credentials.tokenSecret)
+				return session, nil
+			}
+			if err := session.Login(credentials.username, credentials.password, credentials.otp); err != nil {
+				return nil, err
+			}
+			return session, nil
+		},
+		endpoint:     endpoint,
+		credentials:  credentials,
+		versionMajor: major,
+		versionMinor: minor,
+	}, nil
+}
+
+// forEndpoint returns a client for endpoint, logged in with the credentials and taking the
+// settings of c. It's c itself for an empty endpoint or the one of c, clients of other endpoints
+// are created once and shared.
+func (c *apiClient) forEndpoint(endpoint string) (*apiClient, error) {
+	endpoint = strings.TrimRight(endpoint, "/")
+	if endpoint == "" || endpoint == c.endpoint {
+		return c, nil
+	}
+
+	c.endpointMu.Lock()
+	defer c.endpointMu.Unlock()
+
+	if client, ok := c.endpoints[endpoint]; ok {
+		return client, nil
+	}
+	// the otp was used up logging in to the provider endpoint
+	if c.credentials.otp != "" && !c.credentials.useToken() {
+		return nil, fmt.Errorf("can't login to endpoint %s with otp, authenticate with api_token_id instead", endpoint)
+	}
+	client, err := newAPIClient(endpoint, c.credentials)
+	if err != nil {
+		return nil, fmt.Errorf("failed to login to endpoint %s: %s", endpoint, err)
+	}
+	client.managementTag = c.managementTag
+	client.skipIPWait = c.skipIPWait
+	client.debugCommands = c.debugCommands
+	client.maxClonesPerNode = c.maxClonesPerNode
+	if c.endpoints == nil {
+		c.endpoints = map[string]*apiClient{}
+	}
+	c.endpoints[endpoint] = client
+	return client, nil
+}
+
+// acquireClone waits for a free clone slot of node, see max_clones_per_node. The returned func
+// releases the slot.
+func (c *apiClient) acquireClone(ctx context.Context, node string) (release func(), err error) {
+	if c.maxClonesPerNode <= 0 {
+		return func() {}, nil
+	}
+
+	c.cloneMu.Lock()
+	if c.cloneSlots == nil {
+		c.cloneSlots = map[string]chan struct{}{}
+	}
+	slots, ok := c.cloneSlots[node]
+	if !ok {
+		slots = make(chan struct{}, c.maxClonesPerNode)
+		c.cloneSlots[node] = slots
+	}
+	c.cloneMu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for a clone slot of node %s: %s", node, ctx.Err())
 	}
 }
@@ -1,8 +1,17 @@
 package provider
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	pxapi "github.com/Telmate/proxmox-api-go/proxmox"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
 )
 
@@ -26,3 +35,191 @@ func testAccPreCheck(t *testing.T) {
 	// about the appropriate environment variables being set are common to see in a pre-check
 	// function.
 }
+
+func TestParseVersion(t *testing.T) {
+	cases := []struct {
+		version      string
+		major, minor int
+		err          bool
+	}{
+		{version: "7.1-10", major: 7, minor: 1},
+		{version: "8.1.3", major: 8, minor: 1},
+		{version: "6.4-13", major: 6, minor: 4},
+		{version: "unknown", err: true},
+	}
+
+	for _, c := range cases {
+		major, minor, err := parseVersion(c.version)
+		if (err != nil) != c.err || major != c.major || minor != c.minor {
+			t.Errorf("parseVersion(%q) = %d, %d, %v; want %d, %d, error %v", c.version, major, minor, err, c.major, c.minor, c.err)
+		}
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	c := &apiClient{versionMajor: 7, versionMinor: 4}
+	if err := c.checkVersion(6, 2, "tags"); err != nil {
+		t.Errorf("7.4 should satisfy 6.2: %s", err)
+	}
+	if err := c.checkVersion(7, 4, "tags"); err != nil {
+		t.Errorf("7.4 should satisfy 7.4: %s", err)
+	}
+	if err := c.checkVersion(8, 1, "ci_upgrade"); err == nil {
+		t.Errorf("7.4 should not satisfy 8.1")
+	}
+}
+
+func TestIsVMNotFound(t *testing.T) {
+	cases := map[string]bool{
+		"vm '100' not found": true,
+		"500 Configuration file 'nodes/pve/qemu-server/100.conf' does not exist": true,
+		"vm '101' not found":         false,
+		"500 can't lock file":        false,
+		"401 authentication failure": false,
+	}
+	for msg, want := range cases {
+		if got := isVMNotFound(errors.New(msg), 100); got != want {
+			t.Errorf("isVMNotFound(%q) = %v; want %v", msg, got, want)
+		}
+	}
+}
+
+func TestForEndpoint(t *testing.T) {
+	c := &apiClient{endpoint: "https://pve1:8006", credentials: apiCredentials{username: "root@pam", password: "secret", otp: "123456"}}
+	for _, endpoint := range []string{"", "https://pve1:8006", "https://pve1:8006/"} {
+		if client, err := c.forEndpoint(endpoint); err != nil || client != c {
+			t.Errorf("forEndpoint(%q) = %p, %v; want the provider client", endpoint, client, err)
+		}
+	}
+	if _, err := c.forEndpoint("https://pve2:8006"); err == nil {
+		t.Errorf("forEndpoint of another endpoint should fail with otp")
+	}
+}
+
+func TestAcquireClone(t *testing.T) {
+	c := &apiClient{maxClonesPerNode: 1}
+	release, err := c.acquireClone(context.Background(), "pve1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// another node has its own slots
+	releaseOther, err := c.acquireClone(context.Background(), "pve2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseOther()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.acquireClone(ctx, "pve1"); err == nil {
+		t.Fatalf("acquired a second clone slot of pve1")
+	}
+
+	release()
+	release, err = c.acquireClone(context.Background(), "pve1")
+	if err != nil {
+		t.Fatalf("slot of pve1 not released: %s", err)
+	}
+	release()
+}
+
+func TestWaitForTask(t *testing.T) {
+	polls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/nodes/pve/tasks/UPID:pve:clone/status":
+			polls++
+			if polls < 3 {
+				fmt.Fprint(w, `{"data":{"status":"running"}}`)
+				return
+			}
+			fmt.Fprint(w, `{"data":{"status":"stopped","exitstatus":"OK"}}`)
+		case "/nodes/pve/tasks/UPID:pve:warnings/status":
+			fmt.Fprint(w, `{"data":{"status":"stopped","exitstatus":"WARNINGS: 2"}}`)
+		case "/nodes/pve/tasks/UPID:pve:locked/status":
+			fmt.Fprint(w, `{"data":{"status":"stopped","exitstatus":"can't lock file '/var/lock/qemu-server/lock-100.conf' - got timeout"}}`)
+		default:
+			fmt.Fprint(w, `{"data":{"status":"running"}}`)
+		}
+	}))
+	defer server.Close()
+
+	session, err := pxapi.NewSession(server.URL, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &apiClient{session: session}
+	defer func(d time.Duration) { pollDuration = d }(pollDuration)
+	pollDuration = time.Millisecond
+
+	if err := waitForTask(context.Background(), client, "pve", "UPID:pve:clone", time.Second); err != nil || polls != 3 {
+		t.Errorf("waitForTask of finishing task = %v after %d polls; want nil after 3", err, polls)
+	}
+	if err := waitForTask(context.Background(), client, "pve", "UPID:pve:warnings", time.Second); err != nil {
+		t.Errorf("waitForTask of task with warnings = %v; want nil", err)
+	}
+	if err := waitForTask(context.Background(), client, "pve", "UPID:pve:locked", time.Second); err == nil || !strings.Contains(err.Error(), "got timeout") {
+		t.Errorf("waitForTask of failed task = %v; want the exit status", err)
+	}
+	if err := waitForTask(context.Background(), client, "pve", "UPID:pve:hang", 10*time.Millisecond); err == nil {
+		t.Errorf("waitForTask of hanging task passed; want a timeout")
+	}
+	if err := waitForTask(context.Background(), client, "pve", "", time.Second); err != nil {
+		t.Errorf("waitForTask without task = %v; want nil", err)
+	}
+}
+
+func TestStorageAvail(t *testing.T) {
+	path := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		fmt.Fprint(w, `{"data":{"avail":1073741824,"total":2147483648}}`)
+	}))
+	defer server.Close()
+
+	session, err := pxapi.NewSession(server.URL, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &apiClient{session: session}
+
+	avail, err := client.storageAvail("pve2", "local")
+	if err != nil || avail != 1<<30 {
+		t.Errorf("storageAvail = %d, %v; want %d", avail, err, 1<<30)
+	}
+	if want := "/nodes/pve2/storage/local/status"; path != want {
+		t.Errorf("storageAvail requested %s; want %s", path, want)
+	}
+}
+
+func TestMoveToPool(t *testing.T) {
+	requests := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+r.PostForm.Encode())
+		if r.URL.Path == "/pools/missing" {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"data":null}`)
+			return
+		}
+		fmt.Fprint(w, `{"data":null}`)
+	}))
+	defer server.Close()
+
+	session, err := pxapi.NewSession(server.URL, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &apiClient{session: session}
+
+	if err := client.moveToPool(100, "old", "new"); err != nil {
+		t.Errorf("moveToPool = %v; want nil", err)
+	}
+	want := []string{"PUT /pools/old delete=1&vms=100", "PUT /pools/new vms=100"}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("moveToPool requests = %v; want %v", requests, want)
+	}
+	if err := client.moveToPool(100, "", "missing"); err == nil {
+		t.Errorf("moveToPool into a pool failing the request passed; want an error")
+	}
+}
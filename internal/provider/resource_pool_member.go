@@ -0,0 +1,132 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	pxapi "github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+)
+
+func resourcePoolMember() *schema.Resource {
+	return &schema.Resource{
+		Description: "Membership of a VM in a resource pool, managed independently of the VM itself. A VM belongs to at most one pool, adding it here moves it out of its current pool.",
+
+		CreateContext: resourcePoolMemberCreate,
+		ReadContext:   resourcePoolMemberRead,
+		DeleteContext: resourcePoolMemberDelete,
+
+		Schema: map[string]*schema.Schema{
+			"poolid": {
+				Description:  "Pool to add the VM into.",
+				Type:         schema.TypeString,
+				Required:     true,
+				ForceNew:     true,
+				ValidateFunc: validation.StringIsNotEmpty,
+			},
+			"vmid": {
+				Description:  "ID of the VM.",
+				Type:         schema.TypeInt,
+				Required:     true,
+				ForceNew:     true,
+				ValidateFunc: validation.IntAtLeast(100),
+			},
+		},
+	}
+}
+
+func resourcePoolMemberCreate(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*apiClient)
+
+	poolid := d.Get("poolid").(string)
+	vmid := d.Get("vmid").(int)
+
+	vmref := pxapi.NewVmRef(vmid)
+	if err := client.CheckVmRef(vmref); err != nil {
+		return diag.Errorf("failed to check vm: %s", err)
+	}
+
+	if err := client.moveToPool(vmid, vmref.Pool(), poolid); err != nil {
+		return diag.Errorf("failed to add vm %d into pool %s: %s", vmid, poolid, err)
+	}
+	tflog.Debug(ctx, "vm added into pool", map[string]interface{}{"vmid": vmid, "poolid": poolid})
+
+	d.SetId(fmt.Sprintf("%s/%d", poolid, vmid))
+
+	return resourcePoolMemberRead(ctx, d, meta)
+}
+
+func resourcePoolMemberRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*apiClient)
+
+	poolid, vmid, err := parsePoolMemberID(d.Id())
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	vmref := pxapi.NewVmRef(vmid)
+	if err := client.CheckVmRef(vmref); err != nil {
+		if isVMNotFound(err, vmid) {
+			d.SetId("")
+			return nil
+		}
+		return diag.FromErr(err)
+	}
+
+	if vmref.Pool() != poolid {
+		tflog.Warn(ctx, "vm is no longer a member of pool", map[string]interface{}{"vmid": vmid, "poolid": poolid, "current": vmref.Pool()})
+		d.SetId("")
+		return nil
+	}
+
+	d.Set("poolid", poolid)
+	d.Set("vmid", vmid)
+
+	return nil
+}
+
+func resourcePoolMemberDelete(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*apiClient)
+
+	poolid, vmid, err := parsePoolMemberID(d.Id())
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	vmref := pxapi.NewVmRef(vmid)
+	if err := client.CheckVmRef(vmref); err != nil {
+		if isVMNotFound(err, vmid) {
+			return nil
+		}
+		return diag.FromErr(err)
+	}
+
+	// membership may have been changed outside of terraform, only remove our own
+	if vmref.Pool() != poolid {
+		return nil
+	}
+
+	if err := client.moveToPool(vmid, poolid, ""); err != nil {
+		return diag.Errorf("failed to remove vm %d from pool %s: %s", vmid, poolid, err)
+	}
+	tflog.Debug(ctx, "vm removed from pool", map[string]interface{}{"vmid": vmid, "poolid": poolid})
+
+	return nil
+}
+
+func parsePoolMemberID(id string) (string, int, error) {
+	i := strings.LastIndex(id, "/")
+	if i < 0 {
+		return "", 0, fmt.Errorf("invalid pool member id %q, expected <poolid>/<vmid>", id)
+	}
+	vmid, err := strconv.Atoi(id[i+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid vmid in pool member id %q: %s", id, err)
+	}
+	return id[:i], vmid, nil
+}
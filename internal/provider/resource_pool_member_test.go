@@ -0,0 +1,44 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
+)
+
+func TestAccResourcePoolMember(t *testing.T) {
+	config := `
+	resource "pve_vm" "vm1" {
+		name = "test-vm1-pool-member"
+		template_name = "debian-10.11.4-20220312"
+		target_node = "pve"
+		target_storage = "local"
+		cores = 1
+		memory = 512
+	}
+
+	resource "pve_pool_member" "member" {
+		poolid = "test-pool"
+		vmid = pve_vm.vm1.id
+	}
+	`
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_pool_member.member", "poolid", "test-pool"),
+					resource.TestCheckResourceAttrPair("pve_pool_member.member", "vmid", "pve_vm.vm1", "id"),
+					testAccCheckVMInPool("pve_vm.vm1", "test-pool"),
+				),
+			},
+			{
+				// the pool read back into pve_vm doesn't plan to move the vm out again
+				Config:   config,
+				PlanOnly: true,
+			},
+		},
+	})
+}
@@ -5,18 +5,26 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
 	"net/url"
 	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+	// embedded tz database for validating timezone where the host has none
+	_ "time/tzdata"
 
 	pxapi "github.com/Telmate/proxmox-api-go/proxmox"
 	"golang.org/x/net/websocket"
+	"gopkg.in/yaml.v3"
 
+	"github.com/hashicorp/go-uuid"
 	"github.com/hashicorp/terraform-plugin-log/tflog"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
@@ -24,9 +32,9 @@ import (
 )
 
 var (
-	waitStoppedTimeout = 5 * time.Minute
-	waitBootUpTimeout  = 5 * time.Minute
-	pollDuration       = 2 * time.Second
+	waitConfigTimeout    = 30 * time.Second
+	waitCloudInitTimeout = 10 * time.Minute
+	pollDuration         = 2 * time.Second
 )
 
 func resourceVM() *schema.Resource {
@@ -38,6 +46,14 @@ func resourceVM() *schema.Resource {
 		UpdateContext: resourceVMUpdate,
 		DeleteContext: resourceVMDelete,
 
+		CustomizeDiff: resourceVMCustomizeDiff,
+
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(20 * time.Minute),
+			Update: schema.DefaultTimeout(20 * time.Minute),
+			Delete: schema.DefaultTimeout(10 * time.Minute),
+		},
+
 		Schema: map[string]*schema.Schema{
 			"name": {
 				Description: "VM name.",
@@ -49,14 +65,41 @@ func resourceVM() *schema.Resource {
 				),
 			},
 			"template_name": {
-				Description: "VM template.",
-				Type:        schema.TypeString,
-				Required:    true,
+				Description:   "VM template.",
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"import_ovf"},
 				ValidateFunc: validation.All(
 					validation.StringIsNotEmpty,
 					validation.StringMatch(regexp.MustCompile(`(?m)^[a-zA-Z0-9-.]+$`), "not a valid DNS name"),
 				),
 			},
+			"full_clone": {
+				Description: "Create a full copy of the template disks. Set to `false` for a linked clone sharing the template disks, which is created instantly and takes little space but needs a storage supporting it, eg. lvm-thin, zfs or qcow2 on a directory. Changing it only affects later clones, like the one of a template switch.",
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     true,
+			},
+			"template_switch_strategy": {
+				Description:  "How a change of `template_name` is applied. `disk_swap` replaces the disks of the vm with the ones of the new template in place, keeping the vm id and config. `recreate` destroys the vm and creates it again from the new template. `blue_green` creates the new vm first and destroys the old one only once the new one is up, so the vm gets a new id.",
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "disk_swap",
+				ValidateFunc: validation.StringInSlice([]string{"disk_swap", "recreate", "blue_green"}, false),
+			},
+			"import_ovf": {
+				Description:  "Path to an OVF manifest on `target_node`. When set, the VM is created by importing the manifest into `target_storage` instead of cloning `template_name`, and a cloud-init drive is attached as `ide2` unless the manifest brings one. Creating fails when the manifest uses `ide2` for another drive.",
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				ValidateFunc: validation.StringIsNotEmpty,
+			},
+			"netboot": {
+				Description: "Set to `true` to create a bare vm booting from network, for PXE and diskless setups, instead of cloning `template_name`. It has no cloud-init drive and its first `network` block is the boot device. It starts without disks, `disk` blocks are attached as usual, eg. for a PXE installer to install onto.",
+				Type:        schema.TypeBool,
+				Optional:    true,
+				ForceNew:    true,
+			},
 			"target_node": {
 				Description:  "Node where this vm sit.",
 				Type:         schema.TypeString,
@@ -64,20 +107,109 @@ func resourceVM() *schema.Resource {
 				ForceNew:     true,
 				ValidateFunc: validation.StringIsNotEmpty,
 			},
+			"anti_affinity_group": {
+				Description:   "Spreads the vms of a group over the nodes. The vm is cloned to the online node with the fewest vms of the group, preferring `target_node` on a tie, and tagged `anti-affinity.<group>` to record the membership. The template must be usable from every node, eg. be on shared storage.",
+				Type:          schema.TypeString,
+				Optional:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"import_ovf"},
+				ValidateFunc:  validation.StringMatch(regexp.MustCompile(`^[a-z0-9_+.-]+$`), "must be lowercase letters, digits or _+.-"),
+			},
+			"node": {
+				Description: "Node the vm currently sits on.",
+				Type:        schema.TypeString,
+				Computed:    true,
+			},
+			"description": {
+				Description: "Notes of this vm shown in pve. It's stored as is, attributes computed by pve like the vm id or ip address can't be referenced, use HCL templating with other values instead.",
+				Type:        schema.TypeString,
+				Optional:    true,
+				// pve drops trailing newlines, eg. of heredoc strings
+				DiffSuppressFunc: func(k, old, new string, d *schema.ResourceData) bool {
+					return strings.TrimRight(old, "\n") == strings.TrimRight(new, "\n")
+				},
+			},
+			"tags": {
+				Description: "Tags of the vm, shown and searchable in pve. The `management_tag` and the tag of `anti_affinity_group` are added along and not listed here. Applied without restart.",
+				Type:        schema.TypeSet,
+				Optional:    true,
+				Elem: &schema.Schema{
+					Type:         schema.TypeString,
+					ValidateFunc: validation.StringMatch(regexp.MustCompile(`^[a-z0-9_][a-z0-9_+.-]*$`), "not a valid pve tag"),
+				},
+			},
+			"endpoint": {
+				Description:  "Url of the pve api of the cluster to create the vm in, overriding the `endpoint` of the provider. It's logged in to with the credentials of the provider, which can't be an `otp`. Changing it creates the vm in the other cluster.",
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				ValidateFunc: validation.IsURLWithScheme([]string{"http", "https"}),
+			},
+			"pool": {
+				Description: "Resource pool to create the VM in. The clone is created inside the pool, so the pool's permissions apply from the start. Changing it moves the vm to the other pool without restart. Leave it unset to keep the pool the vm is in, eg. one `pve_pool_member` added it to.",
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+			},
+			"acpi": {
+				Description: "Whether ACPI is enabled for the vm. Without ACPI the guest can't be shutdown gracefully, so it is stopped right away whenever this provider needs it powered off. Changing it restarts the vm.",
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     true,
+			},
 			"onboot": {
-				Description: "Specifies whether a VM will be started during system bootup.",
+				Description: "Specifies whether a VM will be started during system bootup. Applied without restart.",
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+			},
+			"protection": {
+				Description: "Sets the protection flag of the vm, pve then refuses to remove the vm and its disks. Applied without restart.",
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+			},
+			"auto_clear_protection": {
+				Description: "Clear `protection` when terraform destroys the vm instead of failing. Like other settings it's taken from the state, so it has to be applied before the destroy.",
 				Type:        schema.TypeBool,
 				Optional:    true,
+				Default:     false,
+			},
+			"acl": {
+				Description: "Roles granted on the vm, ie. on the `/vms/{vmid}` acl path, right after it's created. Once set, the acl of the vm is managed as a whole, entries added outside of terraform show up as drift.",
+				Type:        schema.TypeSet,
+				Optional:    true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"type": {
+							Description:  "Kind of `id`, one of `user`, `group` and `token`.",
+							Type:         schema.TypeString,
+							Optional:     true,
+							Default:      "user",
+							ValidateFunc: validation.StringInSlice([]string{"user", "group", "token"}, false),
+						},
+						"id": {
+							Description: "User, group or api token the role is granted to, eg. `alice@pve` or `ci@pve!deploy`.",
+							Type:        schema.TypeString,
+							Required:    true,
+						},
+						"role": {
+							Description: "Role granted, eg. `PVEVMUser`.",
+							Type:        schema.TypeString,
+							Required:    true,
+						},
+					},
+				},
 			},
 			"status": {
-				Description:  "Desired VM status",
+				Description:  "Desired VM status, one of `running`, `stopped` or `paused`. A paused vm keeps its memory but doesn't execute, without shutting down the guest. The actual status is read back on every refresh, so the next apply brings a vm started or stopped outside of terraform back to this status.",
 				Type:         schema.TypeString,
 				Optional:     true,
 				Default:      "running",
-				ValidateFunc: validation.StringInSlice([]string{"running", "stopped"}, false),
+				ValidateFunc: validation.StringInSlice([]string{"running", "stopped", "paused"}, false),
 			},
 			"target_storage": {
-				Description:  "Storage where this vm sit.",
+				Description:  "Storage the disks of the template are cloned to, and the default storage of the `disk` blocks and the cloud-init drive. A linked clone (`full_clone = false`) keeps the template disks on the storage of the template, as its disks are based on them.",
 				Type:         schema.TypeString,
 				Required:     true,
 				ForceNew:     true,
@@ -89,498 +221,3563 @@ func resourceVM() *schema.Resource {
 				Required:     true,
 				ValidateFunc: validation.IntAtLeast(1),
 			},
+			"sockets": {
+				Description:  "Number of cpu sockets, `cores` is the number of cores per socket. Changing it restarts the vm.",
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      1,
+				ValidateFunc: validation.IntAtLeast(1),
+			},
+			"vcpus": {
+				Description:  "Number of vcpus online, at most `sockets` * `cores`. With `cpu` hotplug enabled, changing it brings vcpus online or offline without restarting the vm. Defaults to all vcpus.",
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Computed:     true,
+				ValidateFunc: validation.IntAtLeast(1),
+			},
 			"memory": {
 				Description:  "Memory size in Megabyte",
 				Type:         schema.TypeInt,
 				Required:     true,
 				ValidateFunc: validation.IntAtLeast(1),
 			},
+			"balloon": {
+				Description:  "Minimum memory in Megabyte the balloon device may shrink the vm to when the node is under memory pressure, `0` disables the balloon device. pve defaults to `memory`, which disables ballooning but keeps the device. Read from the config, not from the momentary balloon size. Changing it between `0` and another value restarts the vm.",
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Computed:     true,
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"memory_shares": {
+				Description:  "Amount of memory shares for auto-ballooning, the more shares the more memory this vm gets when the node is under memory pressure. It only matters when the balloon minimum is lower than `memory`.",
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Computed:     true,
+				ValidateFunc: validation.IntBetween(0, 50000),
+			},
+			"cpu_type": {
+				Description:  "CPU model emulated for the vm, eg. `host`, `kvm64` or `x86-64-v2-AES`, or `custom-` followed by the name of a custom model. Pin a model all nodes support to live migrate between heterogeneous nodes. Left as the template has it when unset. Changing this restarts the vm.",
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ValidateFunc: validation.StringMatch(regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`), "not a valid cpu model"),
+			},
+			"cpu_flags": {
+				Description: "CPU flags to enable (`+flag`) or disable (`-flag`), eg. `+aes`. Left as the template has them when unset. Changing this restarts the vm.",
+				Type:        schema.TypeList,
+				Optional:    true,
+				Computed:    true,
+				Elem: &schema.Schema{
+					Type:         schema.TypeString,
+					ValidateFunc: validation.StringMatch(regexp.MustCompile(`^[+-][a-zA-Z0-9_.-]+$`), "cpu flag must start with + or -"),
+				},
+			},
+			"hotplug": {
+				Description: "Hotplug features to enable, any of `network`, `disk`, `cpu`, `memory`, `usb` and `cloudinit`. An empty set disables hotplug entirely, leave it unset to keep the vm's current setting.",
+				Type:        schema.TypeSet,
+				Optional:    true,
+				Computed:    true,
+				Elem: &schema.Schema{
+					Type:         schema.TypeString,
+					ValidateFunc: validation.StringInSlice([]string{"network", "disk", "cpu", "memory", "usb", "cloudinit"}, false),
+				},
+			},
+			"agent": {
+				Description: "QEMU guest agent settings. Leave it unset to keep the setting of the template. Changing it restarts the vm.",
+				Type:        schema.TypeList,
+				Optional:    true,
+				Computed:    true,
+				MaxItems:    1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"enabled": {
+							Description: "Whether the guest agent is enabled, it's used to find out ip addresses of the vm.",
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Default:     true,
+						},
+						"type": {
+							Description:  "Agent interface type, `virtio` or `isa`.",
+							Type:         schema.TypeString,
+							Optional:     true,
+							Default:      "virtio",
+							ValidateFunc: validation.StringInSlice([]string{"virtio", "isa"}, false),
+						},
+						"fstrim_cloned_disks": {
+							Description: "Run fstrim in the guest after a disk is moved or the vm migrated.",
+							Type:        schema.TypeBool,
+							Optional:    true,
+						},
+						"freeze_fs_on_backup": {
+							Description: "Freeze guest filesystems during backups for consistency.",
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Default:     true,
+						},
+					},
+				},
+			},
+			"vga": {
+				Description: "Display device settings. Leave it unset to keep the setting of the template. Changing it restarts the vm.",
+				Type:        schema.TypeList,
+				Optional:    true,
+				Computed:    true,
+				MaxItems:    1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"type": {
+							Description:  "Display device type, eg. `std`, `qxl` for SPICE or `serial0` to use a serial terminal.",
+							Type:         schema.TypeString,
+							Optional:     true,
+							Default:      "std",
+							ValidateFunc: validation.StringMatch(regexp.MustCompile(`^(std|cirrus|vmware|qxl[234]?|serial[0-3]|virtio(-gl)?|none)$`), "not a valid vga type"),
+						},
+						"memory": {
+							Description:  "Display device memory in MB, raise it for high resolutions or multiple SPICE monitors. Defaults to the pve default of the type.",
+							Type:         schema.TypeInt,
+							Optional:     true,
+							ValidateFunc: validation.IntBetween(4, 512),
+						},
+					},
+				},
+			},
+			"rng": {
+				Description: "VirtIO random number generator feeding the guest entropy from the host. Leave it unset to keep the setting of the template. Changing it restarts the vm.",
+				Type:        schema.TypeList,
+				Optional:    true,
+				Computed:    true,
+				MaxItems:    1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"source": {
+							Description:  "Entropy source on the host, one of `/dev/urandom`, `/dev/random` and `/dev/hwrng`.",
+							Type:         schema.TypeString,
+							Optional:     true,
+							Default:      "/dev/urandom",
+							ValidateFunc: validation.StringInSlice([]string{"/dev/urandom", "/dev/random", "/dev/hwrng"}, false),
+						},
+						"max_bytes": {
+							Description:  "Maximum bytes of entropy passed to the guest every `period`, `0` disables the limit.",
+							Type:         schema.TypeInt,
+							Optional:     true,
+							Default:      1024,
+							ValidateFunc: validation.IntAtLeast(0),
+						},
+						"period": {
+							Description:  "Period in milliseconds `max_bytes` applies to.",
+							Type:         schema.TypeInt,
+							Optional:     true,
+							Default:      1000,
+							ValidateFunc: validation.IntAtLeast(1),
+						},
+					},
+				},
+			},
+			"hostpci": {
+				Description: "PCI devices of the host passed through to the vm, the first block is `hostpci0`. Changing them restarts the vm.",
+				Type:        schema.TypeList,
+				Optional:    true,
+				MaxItems:    16,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"host": {
+							Description:  "PCI address of the host device, eg. `0000:01:00.0`, or `01:00` to pass all functions of the device.",
+							Type:         schema.TypeString,
+							Required:     true,
+							ValidateFunc: validation.StringMatch(regexp.MustCompile(`^([0-9a-fA-F]{4}:)?[0-9a-fA-F]{2}:[0-9a-fA-F]{2}(\.[0-7])?$`), "not a valid pci address"),
+						},
+						"mdev": {
+							Description:  "Mediated device type created on the host device, eg. `nvidia-35` for a NVIDIA vGPU or `i915-GVTg_V5_4` for Intel GVT-g, instead of passing the whole device.",
+							Type:         schema.TypeString,
+							Optional:     true,
+							ValidateFunc: validation.StringMatch(regexp.MustCompile(`^[\w.-]+$`), "not a valid mediated device type"),
+						},
+						"pcie": {
+							Description: "Pass the device as PCI Express device, requires the `q35` machine type.",
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Default:     false,
+						},
+						"rombar": {
+							Description: "Make the ROM of the device visible to the guest.",
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Default:     true,
+						},
+					},
+				},
+			},
+			"reboot_timeout": {
+				Description:  "Seconds to wait for the guest to shutdown when an update restarts the vm, after that the vm is stopped forcibly. By default the guest is only shutdown gracefully.",
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ValidateFunc: validation.IntAtLeast(1),
+			},
+			"reset_trigger": {
+				Description: "Arbitrary value, changing it hard resets the running vm like pressing the reset button, without waiting for the guest to shutdown. Useful to recover a hung guest.",
+				Type:        schema.TypeString,
+				Optional:    true,
+			},
 			"user_data": {
-				Description: `cloud-init user data. Use this to provision vm, including ssh public key or password setup. Learn more https://cloudinit.readthedocs.io/en/latest/topics/format.html`,
+				Description:  "cloud-init user data. Use this to provision vm, including ssh public key or password setup. Learn more https://cloudinit.readthedocs.io/en/latest/topics/format.html. User data starting with `#cloud-config` is checked at plan time, invalid yaml fails the plan and top level keys unknown to cloud-init give a warning. Changing it uploads the snippet again, regenerates the cloud-init drive and restarts the vm, cloud-init then runs the new user data as for a new instance on boot. Adding or removing it creates a new vm. The snippet is uploaded to `snippet_storage` through the storage api, which needs `Datastore.AllocateTemplate` on the storage. pve versions that don't take snippets uploads get it written to the snippets directory of the storage through the node shell instead, so the provider account needs `Sys.Console` on the node and the shell user must be able to write there. The shell runs as the user returned by termproxy, which is `root@pam` only when logging in as root.",
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validateUserData,
+			},
+			"timezone": {
+				Description:  "Timezone cloud-init sets in the guest, a tz database name like `Europe/Berlin`. It's written as a vendor data snippet next to `user_data` and needs the same access, a timezone set by `user_data` itself takes precedence.",
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				ValidateFunc: validateTimezone,
+			},
+			"hostname": {
+				Description:  "Hostname cloud-init sets in the guest, defaults to `name`. A hostname other than `name` is written as a vendor data snippet like `timezone` and needs the same access. Without `user_data`, the user data pve generates is written as a snippet as well, which has the hostname of `name` taken out, so changing `ci_password_hash` or `ci_upgrade` later replaces the vm.",
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ValidateFunc: validation.StringMatch(regexp.MustCompile(`^[a-zA-Z0-9-.]+$`), "not a valid DNS name"),
+			},
+			"snippet_storage": {
+				Description: "Storage the cloud-init snippets of `user_data`, `timezone` and `hostname` are written to, it must allow content `snippets`, which is checked when planning. The node shell fallback writes to the directory of the storage, eg. `/var/lib/vz/snippets` for `local`.",
 				Type:        schema.TypeString,
 				Optional:    true,
 				ForceNew:    true,
+				Default:     "local",
 			},
-			"ipv4_address": {
-				Description: "IPv4 Address of this vm.",
+			"ci_password_hash": {
+				Description:  "Crypt hash of the password cloud-init sets for the default user, eg. from `mkpasswd -m sha-512`, so no plaintext password is stored in the vm config. Ignored by cloud-init when `user_data` is set, put the hash into `user_data` instead. Changing it regenerates the cloud-init drive and restarts the vm.",
+				Type:         schema.TypeString,
+				Optional:     true,
+				Sensitive:    true,
+				ValidateFunc: validation.StringMatch(regexp.MustCompile(`^\$[0-9a-z]+\$`), "not a crypt password hash"),
+			},
+			"ci_upgrade": {
+				Description: "Whether cloud-init upgrades packages on first boot. Requires pve 8.1 or later. Changing it regenerates the cloud-init drive without restarting the vm, so it applies on the next boot.",
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+			},
+			"ip_source": {
+				Description:  "Where `ipv4_address` comes from: `agent` asks the guest agent after boot, `config` takes the static address of `ipconfig0` without waiting for the guest, `auto` prefers a static address and falls back to the agent. `network_interfaces` and `ipv6_address` are only reported by the agent.",
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "agent",
+				ValidateFunc: validation.StringInSlice([]string{"agent", "config", "auto"}, false),
+			},
+			"stable_ip": {
+				Description: "Keep `ipv4_address`, `ipv6_address` and `network_interfaces` as recorded when the vm was created or started by this provider, instead of refreshing them from the guest agent on every read. Reduces noise from changing DHCP leases.",
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+			},
+			"wait_for_cloud_init": {
+				Description: "Wait for cloud-init to finish when creating the vm or changing `user_data`, by reading its result through the guest agent. The apply fails when cloud-init reports errors.",
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+			},
+			"cloud_init_status": {
+				Description: "Final cloud-init status observed by `wait_for_cloud_init`, `done` or `error`.",
 				Type:        schema.TypeString,
 				Computed:    true,
 			},
-			"disk": {
-				Description: "Attach extra disk into VM",
+			"cloud_init_drive": {
+				Description: "Settings of the cloud-init drive attached on `ide2` when the template lacks one. Setting the block attaches a drive even without other cloud-init attributes. The drive has the fixed size pve gives it.",
 				Type:        schema.TypeList,
 				Optional:    true,
+				ForceNew:    true,
+				MaxItems:    1,
 				Elem: &schema.Resource{
 					Schema: map[string]*schema.Schema{
 						"storage": {
+							Description: "Storage to create the drive on, defaults to `target_storage`. It must allow disk images.",
+							Type:        schema.TypeString,
+							Optional:    true,
+						},
+						"format": {
+							Description:  "Image format of the drive, one of `raw`, `qcow2` or `vmdk`. Storages other than file based ones, eg. `lvmthin` or `zfspool`, only take `raw`. Defaults to the default format of the storage.",
+							Type:         schema.TypeString,
+							Optional:     true,
+							ValidateFunc: validation.StringInSlice([]string{"raw", "qcow2", "vmdk"}, false),
+						},
+					},
+				},
+			},
+			"has_cloud_init": {
+				Description: "Whether the vm has a cloud-init drive. One is attached on `ide2` when cloud-init attributes are set and the template lacks it.",
+				Type:        schema.TypeBool,
+				Computed:    true,
+			},
+			"ipv4_address": {
+				Description: "IPv4 Address of this vm.",
+				Type:        schema.TypeString,
+				Computed:    true,
+			},
+			"primary_interface": {
+				Description: "Name of the guest interface `ipv4_address` and `ipv6_address` are taken from, eg. `eth0` or `ens18`. Defaults to the first interface with a global IPv4 address.",
+				Type:        schema.TypeString,
+				Optional:    true,
+			},
+			"ipv6_address": {
+				Description: "First global IPv6 address of `primary_interface` reported by the guest agent, link-local and loopback addresses are skipped.",
+				Type:        schema.TypeString,
+				Computed:    true,
+			},
+			"os_info": {
+				Description: "Guest OS reported by the guest agent, refreshed on every read while the agent is up and kept as last seen otherwise.",
+				Type:        schema.TypeList,
+				Computed:    true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"id": {
+							Description: "OS id, eg. `debian`.",
+							Type:        schema.TypeString,
+							Computed:    true,
+						},
+						"name": {
+							Description: "OS name, eg. `Debian GNU/Linux`.",
+							Type:        schema.TypeString,
+							Computed:    true,
+						},
+						"pretty_name": {
+							Description: "OS name with version, eg. `Debian GNU/Linux 11 (bullseye)`.",
+							Type:        schema.TypeString,
+							Computed:    true,
+						},
+						"version": {
+							Description: "OS version, eg. `11 (bullseye)`.",
+							Type:        schema.TypeString,
+							Computed:    true,
+						},
+						"version_id": {
+							Description: "OS version id, eg. `11`.",
+							Type:        schema.TypeString,
+							Computed:    true,
+						},
+						"kernel_release": {
+							Description: "Kernel release, eg. `5.10.0-13-amd64`.",
+							Type:        schema.TypeString,
+							Computed:    true,
+						},
+						"kernel_version": {
+							Description: "Kernel version, eg. `#1 SMP Debian 5.10.106-1 (2022-03-17)`.",
+							Type:        schema.TypeString,
+							Computed:    true,
+						},
+						"machine": {
+							Description: "Machine hardware name, eg. `x86_64`.",
+							Type:        schema.TypeString,
+							Computed:    true,
+						},
+					},
+				},
+			},
+			"network_interfaces": {
+				Description: "Network interfaces reported by the guest agent, eg. to reference addresses of secondary nics.",
+				Type:        schema.TypeList,
+				Computed:    true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": {
 							Type:     schema.TypeString,
-							Required: true,
+							Computed: true,
 						},
-						"size": {
-							Type:        schema.TypeInt,
-							Required:    true,
-							Description: "Size in GB",
+						"mac_address": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						"mac": {
+							Description: "Same as `mac_address`.",
+							Type:        schema.TypeString,
+							Computed:    true,
+							Deprecated:  "use mac_address instead",
+						},
+						"ip_addresses": {
+							Type:     schema.TypeList,
+							Computed: true,
+							Elem:     &schema.Schema{Type: schema.TypeString},
 						},
 					},
 				},
 			},
-		},
-	}
-}
-
-func resourceVMCreate(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
-	client := meta.(*apiClient)
-
-	tplrefs, err := client.GetVmRefsByName(d.Get("template_name").(string))
-	if err != nil {
-		return diag.FromErr(err)
-	}
-
-	if len(tplrefs) == 0 {
-		return diag.Errorf("template not found")
-	} else if len(tplrefs) > 1 {
-		return diag.Errorf("found multiple template with same template_name")
-	}
-
-	tplref := tplrefs[0]
-	if tplref.GetVmType() != "qemu" {
-		return diag.Errorf("template is not for qemu vm")
-	}
-
-	newid, err := client.GetNextID(0)
-	if err != nil {
-		return diag.Errorf("failed to generate vmid: %s", err)
-	}
-
-	cloneParams := map[string]interface{}{
-		"newid":  newid,
-		"full":   true,
-		"name":   d.Get("name").(string),
-		"target": tplref.Node(),
-	}
-
-	_, err = client.CloneQemuVm(tplref, cloneParams)
-	if err != nil {
-		return diag.Errorf("failed to clone vm %d: %s", tplref.VmId(), err)
-	}
-
-	tflog.Debug(ctx, "vm cloned", map[string]interface{}{"vmid": newid})
-
-	d.SetId(strconv.Itoa(newid))
-
-	vmref := pxapi.NewVmRef(newid)
-
-	updates := map[string]interface{}{}
-	if cores, ok := d.GetOk("cores"); ok {
-		updates["cores"] = cores
-	}
-	if memory, ok := d.GetOk("memory"); ok {
-		updates["memory"] = memory
-	}
-	if onboot, ok := d.GetOk("onboot"); ok {
-		updates["onboot"] = onboot
-	}
-
-	if disks, ok := d.GetOk("disk"); ok {
-		for i, disk := range disks.([]interface{}) {
-			device := fmt.Sprintf("scsi%d", i+1)
-			storage := disk.(map[string]interface{})["storage"].(string)
-			size := disk.(map[string]interface{})["size"].(int)
-			updates[device] = fmt.Sprintf("%s:%d,format=qcow2", storage, size)
-		}
-	}
-	if userData, ok := d.GetOk("user_data"); ok {
+			"state_json": {
+				Description: "Key runtime and config fields of this vm (vmid, node, status, ip addresses, disks and nics) serialized as JSON, for consumption by external tooling.",
+				Type:        schema.TypeString,
+				Computed:    true,
+			},
+			"smbios_uuid": {
+				Description: "SMBIOS UUID recorded when this vm was created. It is verified before the vm is refreshed or deleted, so a reused vmid never points terraform at another vm.",
+				Type:        schema.TypeString,
+				Computed:    true,
+			},
+			"created_at": {
+				Description: "Time when this vm was created by terraform, in RFC 3339 format.",
+				Type:        schema.TypeString,
+				Computed:    true,
+			},
+			"cicustom": {
+				Description: "Custom cloud-init config of the vm as pve has it, referencing the snippets written for `user_data`, `timezone` and `hostname`. It's read back on refresh, a cicustom changed outside of terraform is planned to be restored.",
+				Type:        schema.TypeString,
+				Computed:    true,
+			},
+			"source_template": {
+				Description: "Template the vm was cloned from, recorded when it's created or switched to another template. Compare it with the template currently published under a name to tell vms running an outdated template apart.",
+				Type:        schema.TypeList,
+				Computed:    true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						"vmid": {
+							Type:     schema.TypeInt,
+							Computed: true,
+						},
+					},
+				},
+			},
+			"uptime": {
+				Description: "Seconds since the vm was started, refreshed on every read.",
+				Type:        schema.TypeInt,
+				Computed:    true,
+			},
+			"meta": {
+				Description: "Creation info pve records in the `meta` config of the vm, eg. `creation-qemu` for the qemu version that created it and `ctime` for the creation time in seconds since the epoch. Useful to diagnose migration compatibility.",
+				Type:        schema.TypeMap,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+			},
+			"network": {
+				Description: "Network interfaces of the VM, the n-th block manages `net<n>`. When omitted, network interfaces of the template are kept as is. An added interface is attached live while `hotplug` includes `network`. Without `network` hotplug, any added, changed or removed interface restarts the vm, as pve only applies it on restart.",
+				Type:        schema.TypeList,
+				Optional:    true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"model": {
+							Type:         schema.TypeString,
+							Optional:     true,
+							Default:      "virtio",
+							Description:  "Network card model, one of `virtio`, `e1000`, `rtl8139` and `vmxnet3`.",
+							ValidateFunc: validation.StringInSlice(nicModels, false),
+						},
+						"bridge": {
+							Type:         schema.TypeString,
+							Required:     true,
+							Description:  "Bridge to attach the network interface to, a bridge of `target_node` or a vnet of the cluster's SDN. It's checked to exist when planning.",
+							ValidateFunc: validation.StringIsNotEmpty,
+						},
+						"mtu": {
+							Type:         schema.TypeInt,
+							Optional:     true,
+							Description:  "MTU of the interface, `1` means inherit the MTU of the bridge. Only supported by `virtio`. Changing this restarts the vm.",
+							ValidateFunc: validation.IntBetween(1, 65520),
+						},
+						"queues": {
+							Type:         schema.TypeInt,
+							Optional:     true,
+							Description:  "Number of packet queues, usually set to the number of `cores`. Only supported by `virtio`. Changing this restarts the vm.",
+							ValidateFunc: validation.IntBetween(1, 64),
+						},
+						"link_down": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Description: "Disconnect the network interface while keeping it attached, applied without restart.",
+						},
+						"rate": {
+							Type:        schema.TypeFloat,
+							Optional:    true,
+							Description: "Rate limit in MB/s, applied without restart. Unlimited by default.",
+							ValidateFunc: func(i interface{}, k string) ([]string, []error) {
+								if v, ok := i.(float64); !ok || v <= 0 {
+									return nil, []error{fmt.Errorf("expected %s to be a positive number, got %v", k, i)}
+								}
+								return nil, nil
+							},
+						},
+					},
+				},
+			},
+			"disk": {
+				Description: "Attach extra disk into VM. Disks of each `type` are numbered from 1 in the order of the blocks, eg. `scsi1`, `scsi2`, leaving `scsi0` and alike to the template.",
+				Type:        schema.TypeList,
+				Optional:    true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"type": {
+							Type:         schema.TypeString,
+							Optional:     true,
+							Default:      "scsi",
+							Description:  "Bus the disk is attached to, one of `scsi`, `virtio` and `sata`. A `sata` disk is only attached after a restart. Can't be changed once the disk is added.",
+							ValidateFunc: validation.StringInSlice([]string{"scsi", "virtio", "sata"}, false),
+						},
+						"storage": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Computed:    true,
+							Description: "Storage to allocate the disk on, defaults to `target_storage`. Changing it moves the disk to the new storage without restart. Conflicts with `volid`.",
+						},
+						"volid": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "Volume id of an existing volume to attach instead of allocating a new disk, eg. the same volume attached to several vms of a clustered filesystem. Only used when the disk is added. Removing the disk only detaches the volume. Destroying the vm keeps it unless `destroy_volume` is set. Pve destroys the volumes named after the vm along with it, so destroying a vm that owns the volume, eg. `vm-<vmid>-disk-1`, is refused without `destroy_volume`.",
+						},
+						"destroy_volume": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Default:     false,
+							Description: "Destroy the volume attached by `volid` when the vm is destroyed, even when other vms still use it.",
+						},
+						"shared": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Description: "Mark the volume as available on all nodes, for a locally managed volume shared by other means.",
+						},
+						"size": {
+							Type:        schema.TypeInt,
+							Optional:    true,
+							Description: "Size in GB. Required unless `import_from` or `volid` is set. Growing it resizes the disk without restart, it can't shrink.",
+						},
+						"import_from": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "Absolute path or volume id of an existing raw or qcow2 image to create the disk from, it takes the size of the image. Only used when the disk is added. Requires pve 7.2 or later.",
+						},
+						"backup": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Default:     true,
+							Description: "Include this disk in backups. Can be changed without restart.",
+						},
+						"replicate": {
+							Type:        schema.TypeBool,
+							Optional:    true,
+							Default:     true,
+							Description: "Include this disk in storage replication jobs. Can be changed without restart.",
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func resourceVMCustomizeDiff(ctx context.Context, d *schema.ResourceDiff, meta interface{}) error {
+	// checks against the api are skipped while the provider or endpoint isn't known yet
+	var client *apiClient
+	if c, ok := meta.(*apiClient); ok && d.NewValueKnown("endpoint") {
+		var err error
+		if client, err = c.forEndpoint(d.Get("endpoint").(string)); err != nil {
+			return err
+		}
+	}
+	if d.Id() != "" && d.HasChange("template_name") && d.Get("template_switch_strategy") == "recreate" {
+		if err := d.ForceNew("template_name"); err != nil {
+			return err
+		}
+	}
+	// the sdk takes an empty set of a computed attribute for unset, so disabling hotplug of an
+	// existing vm wouldn't show up in the diff
+	if hotplug := d.GetRawConfig().GetAttr("hotplug"); d.Id() != "" && hotplug.IsKnown() && !hotplug.IsNull() && hotplug.LengthInt() == 0 && d.Get("hotplug").(*schema.Set).Len() > 0 {
+		if err := d.SetNew("hotplug", []string{}); err != nil {
+			return err
+		}
+	}
+	if d.GetRawConfig().GetAttr("hostname").IsNull() {
+		// follows name unless configured
+		if d.HasChange("name") {
+			if err := d.SetNew("hostname", d.Get("name")); err != nil {
+				return err
+			}
+		}
+	} else if d.Id() != "" && d.HasChange("hostname") {
+		if err := d.ForceNew("hostname"); err != nil {
+			return err
+		}
+	}
+	// the cicustom config composed at create only gets its user snippet replaced
+	if oldUserData, newUserData := d.GetChange("user_data"); d.Id() != "" && d.HasChange("user_data") && (oldUserData == "" || newUserData == "") {
+		if err := d.ForceNew("user_data"); err != nil {
+			return err
+		}
+	}
+	// a replacement runs this again without id, leaving cicustom of the new vm unknown
+	if d.Id() != "" && d.NewValueKnown("user_data") && d.NewValueKnown("timezone") && d.NewValueKnown("hostname") && d.NewValueKnown("snippet_storage") {
+		vmid, err := strconv.Atoi(d.Id())
+		if err != nil {
+			return fmt.Errorf("faild to convert resource id to vmid: %s", err)
+		}
+		if expected := expectedCICustom(d, vmid); d.Get("cicustom") != expected {
+			if err := d.SetNew("cicustom", expected); err != nil {
+				return err
+			}
+		}
+	}
+	// the user data pve generated at create is a snapshot, see hostname
+	if hostname := d.Get("hostname"); d.Id() != "" && hostname != "" && hostname != d.Get("name") && d.Get("user_data") == "" {
+		for _, k := range []string{"ci_password_hash", "ci_upgrade"} {
+			if d.HasChange(k) {
+				if err := d.ForceNew(k); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if b := d.GetRawConfig().GetAttr("balloon"); b.IsKnown() && !b.IsNull() && d.NewValueKnown("memory") {
+		if balloon, memory := d.Get("balloon").(int), d.Get("memory").(int); balloon > memory {
+			return fmt.Errorf("balloon %d can't be more than memory %d", balloon, memory)
+		}
+	}
+	if v := d.GetRawConfig().GetAttr("vcpus"); v.IsKnown() && !v.IsNull() && d.NewValueKnown("sockets") && d.NewValueKnown("cores") {
+		if err := checkVCPUs(d.Get("sockets").(int), d.Get("cores").(int), d.Get("vcpus").(int)); err != nil {
+			return err
+		}
+	}
+	// netboot = false counts as set for ExactlyOneOf and ConflictsWith, so its value is checked here
+	if netboot := d.GetRawConfig().GetAttr("netboot"); netboot.IsKnown() {
+		sources := 0
+		for _, k := range []string{"template_name", "import_ovf"} {
+			if !d.GetRawConfig().GetAttr(k).IsNull() {
+				sources++
+			}
+		}
+		if !netboot.IsNull() && netboot.True() {
+			sources++
+			for _, k := range []string{"anti_affinity_group", "user_data", "timezone"} {
+				if !d.GetRawConfig().GetAttr(k).IsNull() {
+					return fmt.Errorf("%s can't be set with netboot", k)
+				}
+			}
+		}
+		if sources != 1 {
+			return fmt.Errorf("exactly one of template_name, import_ovf or netboot = true must be set")
+		}
+	}
+	if d.Get("netboot").(bool) && len(d.Get("network").([]interface{})) == 0 {
+		return fmt.Errorf("netboot requires a network block to boot from")
+	}
+	for i, disk := range d.Get("disk").([]interface{}) {
+		m := disk.(map[string]interface{})
+		if !d.NewValueKnown(fmt.Sprintf("disk.%d.import_from", i)) {
+			continue
+		}
+		if !d.NewValueKnown(fmt.Sprintf("disk.%d.volid", i)) {
+			continue
+		}
+		if m["destroy_volume"].(bool) && m["volid"] == "" && d.NewValueKnown(fmt.Sprintf("disk.%d.volid", i)) {
+			return fmt.Errorf("disk.%d.destroy_volume requires volid, allocated disks are always destroyed with the vm", i)
+		}
+		if m["volid"] != "" {
+			for _, k := range []string{"storage", "import_from"} {
+				if m[k] != "" {
+					return fmt.Errorf("disk.%d.%s conflicts with volid", i, k)
+				}
+			}
+			if m["size"].(int) != 0 {
+				return fmt.Errorf("disk.%d.size conflicts with volid", i)
+			}
+			continue
+		}
+		switch {
+		case m["import_from"] == "" && m["size"].(int) <= 0:
+			return fmt.Errorf("disk.%d.size is required unless import_from or volid is set", i)
+		case m["import_from"] != "" && m["size"].(int) != 0:
+			return fmt.Errorf("disk.%d.size conflicts with import_from, the disk takes the size of the image", i)
+		case m["import_from"] != "":
+			if client != nil {
+				if err := client.checkVersion(7, 2, "disk import_from"); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if d.Id() != "" && d.HasChange("disk") {
+		oldDisks, newDisks := d.GetChange("disk")
+		for i := 0; i < len(oldDisks.([]interface{})) && i < len(newDisks.([]interface{})); i++ {
+			oldDisk := oldDisks.([]interface{})[i].(map[string]interface{})
+			newDisk := newDisks.([]interface{})[i].(map[string]interface{})
+			if oldDisk["type"] != "" && oldDisk["type"] != newDisk["type"] {
+				return fmt.Errorf("disk.%d.type can't be changed from %s to %s", i, oldDisk["type"], newDisk["type"])
+			}
+			if newDisk["size"].(int) < oldDisk["size"].(int) {
+				return fmt.Errorf("disk.%d.size can't shrink from %dG to %dG", i, oldDisk["size"], newDisk["size"])
+			}
+		}
+	}
+	if d.Id() == "" && len(d.Get("cloud_init_drive").([]interface{})) > 0 && d.NewValueKnown("cloud_init_drive") && d.NewValueKnown("target_storage") {
+		if client != nil {
+			if err := checkCloudInitDrive(ctx, client, d); err != nil {
+				return err
+			}
+		}
+	}
+	if d.Id() == "" && d.NewValueKnown("snippet_storage") && writesSnippets(d) {
+		if client != nil {
+			if err := checkSnippetStorage(ctx, client, d.Get("snippet_storage").(string)); err != nil {
+				return err
+			}
+		}
+	}
+	if pool := d.Get("pool").(string); pool != "" && d.HasChange("pool") && d.NewValueKnown("pool") {
+		if client != nil {
+			if err := checkPool(client, pool); err != nil {
+				return err
+			}
+		}
+	}
+	if d.HasChange("network") && d.NewValueKnown("target_node") {
+		if client != nil {
+			if err := checkBridges(ctx, client, d.Get("target_node").(string), d); err != nil {
+				return err
+			}
+		}
+	}
+	if d.HasChange("hostpci") && d.NewValueKnown("target_node") {
+		if client != nil {
+			if err := checkMdevs(ctx, client, d.Get("target_node").(string), d); err != nil {
+				return err
+			}
+		}
+	}
+	for i, nic := range d.Get("network").([]interface{}) {
+		m := nic.(map[string]interface{})
+		if m["model"] == "virtio" {
+			continue
+		}
+		for _, k := range []string{"mtu", "queues"} {
+			if m[k].(int) != 0 {
+				return fmt.Errorf("network.%d.%s is only supported by virtio model", i, k)
+			}
+		}
+	}
+	return nil
+}
+
+func resourceVMCreate(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client, err := meta.(*apiClient).forEndpoint(d.Get("endpoint").(string))
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	// refuse features the cluster doesn't support before anything is created
+	if d.Get("ci_upgrade").(bool) {
+		if err := client.checkVersion(8, 1, "ci_upgrade"); err != nil {
+			return diag.FromErr(err)
+		}
+	}
+	if client.managementTag != "" {
+		if err := client.checkVersion(6, 2, "management_tag"); err != nil {
+			return diag.Errorf("%s, set management_tag to empty string to disable it", err)
+		}
+	}
+	if d.Get("tags").(*schema.Set).Len() > 0 {
+		if err := client.checkVersion(6, 2, "tags"); err != nil {
+			return diag.FromErr(err)
+		}
+	}
+	group := d.Get("anti_affinity_group").(string)
+	if group != "" {
+		if err := client.checkVersion(6, 2, "anti_affinity_group"); err != nil {
+			return diag.FromErr(err)
+		}
+	}
+
+	newid, err := client.GetNextID(0)
+	if err != nil {
+		return diag.Errorf("failed to generate vmid: %s", err)
+	}
+
+	updates := map[string]interface{}{}
+	// set for a clone marked incomplete, see createIncompleteMarker
+	marked := false
+
+	if manifest, ok := d.GetOk("import_ovf"); ok {
+		node := d.Get("target_node").(string)
+		storage := d.Get("target_storage").(string)
+
+		if err := importOVF(ctx, client, node, newid, manifest.(string), storage); err != nil {
+			return diag.Errorf("failed to import ovf: %s", err)
+		}
+
+		tflog.Debug(ctx, "vm imported", map[string]interface{}{"vmid": newid})
+
+		// the import can't be marked incomplete like a clone, so the vm is tracked from here
+		// on and a failure below leaves a tainted resource instead of an orphaned vm
+		d.SetId(strconv.Itoa(newid))
+		d.Set("created_at", time.Now().UTC().Format(time.RFC3339))
+
+		if pool, ok := d.GetOk("pool"); ok {
+			vmref := pxapi.NewVmRef(newid)
+			if err := client.CheckVmRef(vmref); err != nil {
+				return diag.Errorf("failed to check vm: %s", err)
+			}
+			if err := client.moveToPool(newid, vmref.Pool(), pool.(string)); err != nil {
+				return diag.FromErr(err)
+			}
+		}
+
+		updates["name"] = d.Get("name").(string)
+	} else if d.Get("netboot").(bool) {
+		if err := createNetbootVM(ctx, client, d, newid); err != nil {
+			return diag.Errorf("failed to create vm: %s", err)
+		}
+	} else {
+		tplrefs, err := client.GetVmRefsByName(d.Get("template_name").(string))
+		if err != nil {
+			return diag.FromErr(err)
+		}
+
+		if len(tplrefs) == 0 {
+			return diag.Errorf("template not found")
+		} else if len(tplrefs) > 1 {
+			return diag.Errorf("found multiple template with same template_name")
+		}
+
+		tplref := tplrefs[0]
+		if tplref.GetVmType() != "qemu" {
+			return diag.Errorf("template is not for qemu vm")
+		}
+
+		incomplete, description, err := findIncompleteVM(client, d.Get("name").(string))
+		if err != nil {
+			return diag.Errorf("failed to look for vm of an interrupted create: %s", err)
+		}
+		if incomplete != nil {
+			newid = incomplete.VmId()
+			tflog.Info(ctx, "resume interrupted create of vm", map[string]interface{}{"vmid": newid})
+		} else {
+			fullClone := d.Get("full_clone").(bool)
+
+			tplConfig, err := client.GetVmConfig(tplref)
+			if err != nil {
+				return diag.Errorf("failed to get template config: %s", err)
+			}
+			description, _ = tplConfig["description"].(string)
+
+			target := tplref.Node()
+			if group != "" {
+				if target, err = placeAntiAffinity(ctx, client, group, newid, d.Get("target_node").(string)); err != nil {
+					return diag.Errorf("failed to place vm of anti_affinity_group %s: %s", group, err)
+				}
+			}
+
+			// a full clone runs out of space only late, so check up front
+			if fullClone {
+				if err := checkCloneSpace(ctx, client, tplConfig, target, d.Get("target_storage").(string)); err != nil {
+					return diag.FromErr(err)
+				}
+			}
+
+			cloneParams := map[string]interface{}{
+				"newid":       newid,
+				"full":        fullClone,
+				"name":        d.Get("name").(string),
+				"target":      target,
+				"description": withIncompleteMarker(description),
+			}
+			// a linked clone has to stay on the storage of the template disks it's based on
+			if fullClone {
+				cloneParams["storage"] = d.Get("target_storage").(string)
+			}
+			if pool, ok := d.GetOk("pool"); ok {
+				cloneParams["pool"] = pool
+			}
+
+			release, err := client.acquireClone(ctx, target)
+			if err != nil {
+				return diag.FromErr(err)
+			}
+			err = client.cloneQemuVm(ctx, tplref, cloneParams, d.Timeout(schema.TimeoutCreate))
+			release()
+			if err != nil {
+				return diag.FromErr(cloneError(tplref, fullClone, err))
+			}
+
+			tflog.Debug(ctx, "vm cloned", map[string]interface{}{"vmid": newid})
+		}
+		d.Set("source_template", sourceTemplateValue(d.Get("template_name").(string), tplref))
+
+		// the marker goes away with the config written below
+		marked = true
+		if description != "" {
+			updates["description"] = description
+		} else {
+			updates["delete"] = "description"
+		}
+	}
+
+	// a marked clone gets its id once configured, so a failure before leaves no tainted resource
+	// behind but a vm the next create resumes with. An imported vm has its id already.
+	if !marked && d.Id() == "" {
+		d.SetId(strconv.Itoa(newid))
+		d.Set("created_at", time.Now().UTC().Format(time.RFC3339))
+	}
+
+	vmref := pxapi.NewVmRef(newid)
+
+	if cores, ok := d.GetOk("cores"); ok {
+		updates["cores"] = cores
+	}
+	updates["sockets"] = d.Get("sockets")
+	if memory, ok := d.GetOk("memory"); ok {
+		updates["memory"] = memory
+	}
+	if !d.GetRawConfig().GetAttr("balloon").IsNull() {
+		updates["balloon"] = d.Get("balloon")
+	}
+	if !d.GetRawConfig().GetAttr("vcpus").IsNull() {
+		updates["vcpus"] = d.Get("vcpus")
+	}
+	// always written, the template may have onboot enabled
+	updates["onboot"] = d.Get("onboot")
+	updates["protection"] = d.Get("protection")
+	if description, ok := d.GetOk("description"); ok {
+		updates["description"] = description
+		if updates["delete"] == "description" {
+			delete(updates, "delete")
+		}
+	}
+	if !d.Get("acpi").(bool) {
+		updates["acpi"] = false
+	}
+	if agent, ok := d.GetOk("agent"); ok && len(agent.([]interface{})) > 0 {
+		updates["agent"] = agentWithOptions(agent.([]interface{})[0].(map[string]interface{}))
+	}
+	if hash, ok := d.GetOk("ci_password_hash"); ok {
+		updates["cipassword"] = hash
+	}
+	if vga, ok := d.GetOk("vga"); ok && len(vga.([]interface{})) > 0 {
+		updates["vga"] = vgaWithOptions(vga.([]interface{})[0].(map[string]interface{}))
+	}
+	if rng, ok := d.GetOk("rng"); ok && len(rng.([]interface{})) > 0 {
+		updates["rng0"] = rngWithOptions(rng.([]interface{})[0].(map[string]interface{}))
+	}
+	for i, dev := range d.Get("hostpci").([]interface{}) {
+		updates[fmt.Sprintf("hostpci%d", i)] = hostPCIWithOptions(dev.(map[string]interface{}))
+	}
+	// pve upgrades by default, so always write it where supported
+	if client.checkVersion(8, 1, "ci_upgrade") == nil {
+		updates["ciupgrade"] = d.Get("ci_upgrade")
+	}
+	// shares of 0 is meaningful, so check the config rather than GetOk
+	if !d.GetRawConfig().GetAttr("memory_shares").IsNull() {
+		updates["shares"] = d.Get("memory_shares")
+	}
+	if !d.GetRawConfig().GetAttr("hotplug").IsNull() {
+		updates["hotplug"] = hotplugValue(d.Get("hotplug").(*schema.Set))
+	}
+	if tags := vmTags(client, d); len(tags) > 0 {
+		updates["tags"] = strings.Join(tags, ";")
+	}
+	cpuType, hasCPUType := d.GetOk("cpu_type")
+	if flags, ok := d.GetOk("cpu_flags"); ok || hasCPUType {
+		vmConfig, err := client.GetVmConfig(vmref)
+		if err != nil {
+			return diag.Errorf("failed to get vm config: %s", err)
+		}
+		cpu, _ := vmConfig["cpu"].(string)
+		if hasCPUType {
+			cpu = cpuWithType(cpu, cpuType.(string))
+		}
+		if ok {
+			cpu = cpuWithFlags(cpu, expandStringList(flags.([]interface{})))
+		}
+		updates["cpu"] = cpu
+	}
+
+	// disks go into updates with everything else, so pve allocates all of them in the single SetVmConfig call below
+	if disks, ok := d.GetOk("disk"); ok {
+		devices := diskDevices(disks.([]interface{}))
+		for i, disk := range disks.([]interface{}) {
+			updates[devices[i]] = newDiskValue(client, disk.(map[string]interface{}), d.Get("target_storage").(string))
+		}
+	}
+	if nics, ok := d.GetOk("network"); ok {
+		vmConfig, err := client.GetVmConfig(vmref)
+		if err != nil {
+			return diag.Errorf("failed to get vm config: %s", err)
+		}
+		for i, nic := range nics.([]interface{}) {
+			device := fmt.Sprintf("net%d", i)
+			current, _ := vmConfig[device].(string)
+			updates[device] = nicWithOptions(current, nic.(map[string]interface{}))
+		}
+	}
+	snippetStorage := d.Get("snippet_storage").(string)
+	cicustom := []string{}
+	if userData, ok := d.GetOk("user_data"); ok {
+		snippetName := fmt.Sprintf("vm-%d-cloudinit-user-data", vmref.VmId())
+		if diags := writeSnippet(ctx, client, vmref, snippetStorage, snippetName, userData.(string), "user_data"); diags != nil {
+			return diags
+		}
+		cicustom = append(cicustom, "user="+snippetStorage+":snippets/"+snippetName)
+	}
+	// vendor data is merged with the user data, so its settings compose with user_data and the
+	// user data pve generates alike
+	vendorData, vendorAttr := "", ""
+	if timezone, ok := d.GetOk("timezone"); ok {
+		vendorData += fmt.Sprintf("timezone: %s\n", timezone)
+		vendorAttr = "timezone"
+	}
+	hostname := customHostname(d)
+	if hostname != "" {
+		vendorData += fmt.Sprintf("hostname: %s\n", hostname)
+		if vendorAttr == "" {
+			vendorAttr = "hostname"
+		}
+	}
+	if vendorData != "" {
+		snippetName := fmt.Sprintf("vm-%d-cloudinit-vendor-data", vmref.VmId())
+		if diags := writeSnippet(ctx, client, vmref, snippetStorage, snippetName, "#cloud-config\n"+vendorData, vendorAttr); diags != nil {
+			return diags
+		}
+		cicustom = append(cicustom, "vendor="+snippetStorage+":snippets/"+snippetName)
+	}
+	if len(cicustom) > 0 {
+		updates["cicustom"] = strings.Join(cicustom, ",")
+	}
+	// cloud-init never runs without a cloud-init drive, which the template may lack. An imported
+	// ovf always gets one.
+	if usesCloudInit(d) || d.Get("import_ovf") != "" {
+		vmConfig, err := client.GetVmConfig(vmref)
+		if err != nil {
+			return diag.Errorf("failed to get vm config: %s", err)
+		}
+		if _, ok := cloudInitDrive(vmConfig); !ok {
+			if current, ok := vmConfig["ide2"]; ok {
+				return diag.Errorf("failed to attach cloud-init drive: ide2 is already used by %s", current)
+			}
+			updates["ide2"] = cloudInitDriveValue(d)
+		}
+	}
+	if len(updates) > 0 {
+		if err := client.CheckVmRef(vmref); err != nil {
+			return diag.Errorf("failed to check vm: %s", err)
+		}
+		if err := client.setVmConfig(ctx, vmref, updates, d.Timeout(schema.TimeoutCreate)); err != nil {
+			return diag.Errorf("failed to update cpu or memory: %s", err)
+		}
+	}
+	if marked {
+		d.SetId(strconv.Itoa(newid))
+		d.Set("created_at", time.Now().UTC().Format(time.RFC3339))
+	}
+	for _, entry := range aclEntries(d.Get("acl").(*schema.Set)) {
+		if err := client.updateACL(vmACLPath(newid), entry, false); err != nil {
+			return diag.Errorf("failed to grant role %s to %s %s: %s", entry.Role, entry.Type, entry.ID, err)
+		}
+	}
+	// the user data pve generates sets the hostname to name and would override the vendor data, so
+	// it's replaced by a copy without, taken once the settings above are applied
+	if _, ok := d.GetOk("user_data"); hostname != "" && !ok {
+		userData, err := client.cloudInitDump(vmref, "user")
+		if err != nil {
+			return diag.Errorf("failed to get the user data pve generates: %s", err)
+		}
+		snippetName := fmt.Sprintf("vm-%d-cloudinit-user-data", vmref.VmId())
+		if diags := writeSnippet(ctx, client, vmref, snippetStorage, snippetName, withoutHostname(userData), "hostname"); diags != nil {
+			return diags
+		}
+		cicustom = append([]string{"user=" + snippetStorage + ":snippets/" + snippetName}, cicustom...)
+		updates["cicustom"] = strings.Join(cicustom, ",")
+		if _, err := client.SetVmConfig(vmref, map[string]interface{}{"cicustom": updates["cicustom"]}); err != nil {
+			return diag.Errorf("failed to configure hostname: %s", err)
+		}
+	}
+
+	// right after clone the config read back might not have registered yet, agent detection below depends on it
+	keys := []string{}
+	for k := range updates {
+		if k == "delete" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	vmConfig, err := waitVMConfig(ctx, client, vmref, keys, waitConfigTimeout)
+	if err != nil {
+		return diag.Errorf("failed to get vm config: %s", err)
+	}
+	// the uuid tells this vm apart from a later one reusing its vmid, so a vm without one gets one
+	if vmUUID(vmConfig) == "" {
+		smbios, err := smbiosWithUUID(vmConfig)
+		if err != nil {
+			return diag.Errorf("failed to generate smbios uuid: %s", err)
+		}
+		if _, err := client.SetVmConfig(vmref, map[string]interface{}{"smbios1": smbios}); err != nil {
+			return diag.Errorf("failed to set smbios uuid: %s", err)
+		}
+		vmConfig["smbios1"] = smbios
+	}
+	vmConfigToState(ctx, vmConfig, d)
+	d.Set("smbios_uuid", vmUUID(vmConfig))
+	d.Set("node", vmref.Node())
+
+	if status := d.Get("status"); status == "running" || status == "paused" {
+		tflog.Debug(ctx, "start vm", map[string]interface{}{"vmid": vmref.VmId()})
+		_, err = client.StartVm(vmref)
+		if err != nil {
+			return diag.Errorf("failed to start vm %d: %s", vmref.VmId(), err)
+		}
+
+		if diags := refreshVMIP(ctx, client, vmref, d, vmConfig, d.Timeout(schema.TimeoutCreate), !client.skipIPWait, true); diags != nil {
+			return diags
+		}
+
+		if d.Get("wait_for_cloud_init").(bool) {
+			if !parseAgent(vmConfig).Enabled {
+				return diag.Errorf("wait_for_cloud_init requires the guest agent to be enabled")
+			}
+			ciStatus, err := waitCloudInit(ctx, client, vmref, waitCloudInitTimeout)
+			d.Set("cloud_init_status", ciStatus)
+			if err != nil {
+				return diag.FromErr(err)
+			}
+		}
+
+		if status == "paused" {
+			if _, err := client.SuspendVm(vmref); err != nil {
+				return diag.Errorf("failed to pause vm %d: %s", vmref.VmId(), err)
+			}
+		}
+	}
+
+	cicustomValue, _ := vmConfig["cicustom"].(string)
+	d.Set("cicustom", cicustomValue)
+
+	stateJSON, err := vmStateJSON(d, vmref.VmId(), vmref.Node(), vmConfig)
+	if err != nil {
+		return diag.Errorf("failed to serialize vm state: %s", err)
+	}
+	d.Set("state_json", stateJSON)
+
+	return balloonWarnings(vmConfig, !d.GetRawConfig().GetAttr("balloon").IsNull(), !d.GetRawConfig().GetAttr("memory_shares").IsNull())
+}
+
+func resourceVMRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client, err := meta.(*apiClient).forEndpoint(d.Get("endpoint").(string))
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	vmid, err := strconv.Atoi(d.Id())
+	if err != nil {
+		return diag.Errorf("faild to convert resource id to vmid: %s", err)
+	}
+
+	vmref := pxapi.NewVmRef(vmid)
+
+	err = client.CheckVmRef(vmref)
+	if err != nil {
+		if isVMNotFound(err, vmid) {
+			tflog.Warn(ctx, "vm no longer exists", map[string]interface{}{"vmid": vmid})
+			d.SetId("")
+			return nil
+		}
+		return diag.FromErr(err)
+	}
+
+	vmConfig, err := client.GetVmConfig(vmref)
+	if err != nil {
+		if isVMNotFound(err, vmid) {
+			tflog.Warn(ctx, "vm no longer exists", map[string]interface{}{"vmid": vmid})
+			d.SetId("")
+			return nil
+		}
+		return diag.Errorf("failed to get vm config: %s", err)
+	}
+
+	uuid := vmUUID(vmConfig)
+	if expected := d.Get("smbios_uuid").(string); expected != "" && uuid != expected {
+		tflog.Warn(ctx, "vmid is used by another vm, the vm created by terraform is gone", map[string]interface{}{"vmid": vmid, "smbios_uuid": uuid})
+		d.SetId("")
+		return nil
+	}
+	d.Set("smbios_uuid", uuid)
+	d.Set("pool", vmref.Pool())
+	d.Set("node", vmref.Node())
+
+	vmConfigToState(ctx, vmConfig, d)
+	tags, _ := vmConfig["tags"].(string)
+	d.Set("tags", userTags(splitTags(tags), client.managementTag, d.Get("anti_affinity_group").(string)))
+	cicustom, _ := vmConfig["cicustom"].(string)
+	d.Set("cicustom", cicustom)
+
+	// the acl of vms not using acl is left to others
+	if d.Get("acl").(*schema.Set).Len() > 0 {
+		entries, err := client.listACL(vmACLPath(vmid))
+		if err != nil {
+			return diag.Errorf("failed to get acl of vm: %s", err)
+		}
+		d.Set("acl", aclValue(entries))
+	}
+
+	vmState, err := client.GetVmState(vmref)
+	if err != nil {
+		return diag.Errorf("failed to get vm status: %s", err)
+	}
+	d.Set("status", vmStatus(vmState))
+	if uptime, ok := vmState["uptime"].(float64); ok {
+		d.Set("uptime", int(uptime))
+	}
+
+	if vmStatus(vmState) == "running" && !d.Get("stable_ip").(bool) {
+		if diags := refreshVMIP(ctx, client, vmref, d, vmConfig, 1*time.Second, true, false); diags != nil {
+			return diags
+		}
+	}
+	if vmStatus(vmState) == "running" && parseAgent(vmConfig).Enabled {
+		// best effort, the agent may not be up yet
+		if info, err := client.agentOSInfo(vmref); err == nil {
+			d.Set("os_info", []interface{}{osInfoValue(info)})
+		} else {
+			tflog.Debug(ctx, "failed to get os info from guest agent", map[string]interface{}{"err": err.Error()})
+		}
+	}
+
+	stateJSON, err := vmStateJSON(d, vmref.VmId(), vmref.Node(), vmConfig)
+	if err != nil {
+		return diag.Errorf("failed to serialize vm state: %s", err)
+	}
+	d.Set("state_json", stateJSON)
+
+	return nil
+}
+
+func vmConfigToState(ctx context.Context, vmConfig map[string]interface{}, d *schema.ResourceData) {
+	if _, ok := vmConfig["cores"].(float64); !ok {
+		tflog.Warn(ctx, "vm config has no cores, assuming the pve default", map[string]interface{}{"cores": vmCores(vmConfig)})
+	}
+	d.Set("cores", vmCores(vmConfig))
+	d.Set("sockets", vmSockets(vmConfig))
+	// the pve default of memory changed between versions, so rather keep the state
+	if _, ok := vmConfig["memory"].(float64); ok {
+		memory, balloon := vmMemory(vmConfig)
+		d.Set("memory", memory)
+		d.Set("balloon", balloon)
+	} else {
+		tflog.Warn(ctx, "vm config has no memory, keeping memory and balloon of the state")
+	}
+	if vcpus, ok := vmConfig["vcpus"].(float64); ok {
+		d.Set("vcpus", int(vcpus))
+	} else {
+		d.Set("vcpus", vmSockets(vmConfig)*vmCores(vmConfig))
+	}
+	if name, ok := vmConfig["name"].(string); ok {
+		d.Set("name", name)
+		// a hostname other than name is only known from the state
+		if d.Get("hostname") == "" {
+			d.Set("hostname", name)
+		}
+	} else {
+		tflog.Warn(ctx, "vm config has no name, keeping name of the state")
+	}
+	description, _ := vmConfig["description"].(string)
+	d.Set("description", description)
+	protection, _ := vmConfig["protection"].(float64)
+	d.Set("protection", protection == 1)
+	if onboot, ok := vmConfig["onboot"]; ok {
+		d.Set("onboot", onboot == float64(1))
+	} else {
+		d.Set("onboot", false)
+	}
+	d.Set("agent", []interface{}{parseAgent(vmConfig).block()})
+	d.Set("vga", []interface{}{parseVGA(vmConfig)})
+	if rng, ok := parseRNG(vmConfig); ok {
+		d.Set("rng", []interface{}{rng})
+	} else {
+		d.Set("rng", nil)
+	}
+	d.Set("hostpci", parseHostPCI(vmConfig))
+	_, hasCloudInit := cloudInitDrive(vmConfig)
+	d.Set("has_cloud_init", hasCloudInit)
+	d.Set("meta", vmMeta(vmConfig))
+	if acpi, ok := vmConfig["acpi"]; ok {
+		d.Set("acpi", acpi == float64(1))
+	} else {
+		// pve default
+		d.Set("acpi", true)
+	}
+	// it's written on create wherever supported, so a missing value is left alone rather than read as the pve default
+	if ciupgrade, ok := vmConfig["ciupgrade"]; ok {
+		d.Set("ci_upgrade", ciupgrade == float64(1))
+	}
+	if shares, ok := vmConfig["shares"].(float64); ok {
+		d.Set("memory_shares", int(shares))
+	} else {
+		// pve default
+		d.Set("memory_shares", 1000)
+	}
+	flags := []string{}
+	cpuType := ""
+	if cpu, ok := vmConfig["cpu"].(string); ok {
+		l := parsePropertyList(cpu, "cputype")
+		if v, ok := l.Get("flags"); ok && v != "" {
+			flags = strings.Split(v, ";")
+		}
+		cpuType, _ = l.Get("cputype")
+	}
+	d.Set("cpu_flags", flags)
+	d.Set("cpu_type", cpuType)
+
+	if disks := d.Get("disk").([]interface{}); len(disks) > 0 {
+		devices := diskDevices(disks)
+		for i, disk := range disks {
+			value, ok := vmConfig[devices[i]].(string)
+			if !ok {
+				continue
+			}
+			l := parsePropertyList(value, "file")
+			// only sizes managed by the block are tracked, imported and attached volumes keep 0
+			if disk.(map[string]interface{})["size"].(int) > 0 {
+				size, _ := l.Get("size")
+				if bytes, err := parseDiskSize(size); err == nil && bytes > 0 {
+					disk.(map[string]interface{})["size"] = int(bytes >> 30)
+				}
+			}
+			for _, flag := range []string{"backup", "replicate"} {
+				v, _ := l.Get(flag)
+				disk.(map[string]interface{})[flag] = v != "0"
+			}
+			shared, _ := l.Get("shared")
+			disk.(map[string]interface{})["shared"] = shared == "1"
+			if disk.(map[string]interface{})["volid"] != "" {
+				disk.(map[string]interface{})["volid"], _ = l.Get("file")
+			} else {
+				file, _ := l.Get("file")
+				disk.(map[string]interface{})["storage"], _, _ = strings.Cut(file, ":")
+			}
+		}
+		d.Set("disk", disks)
+	}
+
+	if nics := d.Get("network").([]interface{}); len(nics) > 0 {
+		for i, nic := range nics {
+			value, ok := vmConfig[fmt.Sprintf("net%d", i)].(string)
+			if !ok {
+				continue
+			}
+			l := parsePropertyList(value, "")
+			m := nic.(map[string]interface{})
+			for _, model := range nicModels {
+				if _, ok := l.Get(model); ok {
+					m["model"] = model
+				}
+			}
+			m["bridge"], _ = l.Get("bridge")
+			mtu, _ := l.Get("mtu")
+			m["mtu"], _ = strconv.Atoi(mtu)
+			queues, _ := l.Get("queues")
+			m["queues"], _ = strconv.Atoi(queues)
+			linkDown, _ := l.Get("link_down")
+			m["link_down"] = linkDown == "1"
+			rate, _ := l.Get("rate")
+			m["rate"], _ = strconv.ParseFloat(rate, 64)
+		}
+		d.Set("network", nics)
+	}
+
+	hotplug, _ := vmConfig["hotplug"].(string)
+	switch hotplug {
+	case "0":
+		d.Set("hotplug", []string{})
+	case "", "1":
+		// pve default
+		d.Set("hotplug", []string{"network", "disk", "usb"})
+	default:
+		d.Set("hotplug", strings.Split(hotplug, ","))
+	}
+}
+
+var nicModels = []string{"virtio", "e1000", "rtl8139", "vmxnet3"}
+
+// nicWithOptions returns the netN config value with the options of network block applied.
+// The mac address and options not managed by network block are kept from current value.
+func nicWithOptions(current string, nic map[string]interface{}) string {
+	l := parsePropertyList(current, "")
+	mac := ""
+	for _, model := range nicModels {
+		if v, ok := l.Get(model); ok {
+			mac = v
+			l.Delete(model)
+		}
+	}
+	l.Delete("model")
+	l.Delete("macaddr")
+
+	// model goes first and carries mac address as its value, pve generates one if missing
+	model := property{"model", nic["model"].(string)}
+	if mac != "" {
+		model = property{nic["model"].(string), mac}
+	}
+	l.props = append([]property{model}, l.props...)
+
+	l.Set("bridge", nic["bridge"].(string))
+	if mtu := nic["mtu"].(int); mtu > 0 {
+		l.Set("mtu", strconv.Itoa(mtu))
+	} else {
+		l.Delete("mtu")
+	}
+	if queues := nic["queues"].(int); queues > 0 {
+		l.Set("queues", strconv.Itoa(queues))
+	} else {
+		l.Delete("queues")
+	}
+	if nic["link_down"].(bool) {
+		l.Set("link_down", "1")
+	} else {
+		l.Delete("link_down")
+	}
+	if rate := nic["rate"].(float64); rate > 0 {
+		l.Set("rate", strconv.FormatFloat(rate, 'f', -1, 64))
+	} else {
+		l.Delete("rate")
+	}
+	return l.String()
+}
+
+// checkPool checks pool exists, so a typo fails the plan instead of a clone or move.
+func checkPool(client *apiClient, pool string) error {
+	pools, err := client.listPools()
+	if err != nil {
+		return fmt.Errorf("failed to list pools: %s", err)
+	}
+	if !slices.Contains(pools, pool) {
+		return fmt.Errorf("pool %q doesn't exist or isn't visible to the provider account, existing pools: %s", pool, strings.Join(pools, ", "))
+	}
+	return nil
+}
+
+// checkBridges checks the bridge of each network block exists on node, either as a bridge of the
+// node or as an SDN vnet. It's skipped when the bridges can't be listed, eg. without Sys.Audit.
+func checkBridges(ctx context.Context, client *apiClient, node string, d *schema.ResourceDiff) error {
+	bridges, err := client.listBridges(node)
+	if err != nil {
+		tflog.Warn(ctx, "skip checking bridges", map[string]interface{}{"node": node, "err": err.Error()})
+		return nil
+	}
+	for i, nic := range d.Get("network").([]interface{}) {
+		if !d.NewValueKnown(fmt.Sprintf("network.%d.bridge", i)) {
+			continue
+		}
+		bridge := nic.(map[string]interface{})["bridge"].(string)
+		if !slices.Contains(bridges, bridge) {
+			return fmt.Errorf("network.%d.bridge %q is neither a bridge of node %s nor an SDN vnet, available: %s", i, bridge, node, strings.Join(bridges, ", "))
+		}
+	}
+	return nil
+}
+
+// diskDevices returns the config key of each disk block, disks of each type are numbered from 1.
+// Disks in state from before type was added are scsi disks.
+func diskDevices(disks []interface{}) []string {
+	devices := make([]string, len(disks))
+	count := map[string]int{}
+	for i, disk := range disks {
+		diskType, _ := disk.(map[string]interface{})["type"].(string)
+		if diskType == "" {
+			diskType = "scsi"
+		}
+		count[diskType]++
+		devices[i] = fmt.Sprintf("%s%d", diskType, count[diskType])
+	}
+	return devices
+}
+
+// detachDisks detaches devices from vm, then destroys the volumes in destroy as pve leaves them
+// behind as unused disks.
+func detachDisks(client *apiClient, vmref *pxapi.VmRef, devices []string, destroy map[string]bool) error {
+	_, err := client.SetVmConfig(vmref, map[string]interface{}{
+		"delete": strings.Join(devices, ","),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete disk: %s", err)
+	}
+	if len(destroy) == 0 {
+		return nil
+	}
+	vmConfig, err := client.GetVmConfig(vmref)
+	if err != nil {
+		return fmt.Errorf("failed to get vm config: %s", err)
+	}
+	unused := []string{}
+	for k, v := range vmConfig {
+		if file, ok := v.(string); ok && strings.HasPrefix(k, "unused") && destroy[file] {
+			unused = append(unused, k)
+		}
+	}
+	if len(unused) == 0 {
+		return nil
+	}
+	sort.Strings(unused)
+	_, err = client.SetVmConfig(vmref, map[string]interface{}{
+		"delete": strings.Join(unused, ","),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete ununsed disk: %s", err)
+	}
+	return nil
+}
+
+// newDiskValue returns the scsiN config value allocating a new disk for disk block, on
+// defaultStorage unless the block sets its storage. The disk is qcow2 unless the storage only
+// takes raw images.
+func newDiskValue(client *apiClient, disk map[string]interface{}, defaultStorage string) string {
+	if volid := disk["volid"].(string); volid != "" {
+		return diskWithOptions(volid, disk)
+	}
+	storage := disk["storage"].(string)
+	if storage == "" {
+		storage = defaultStorage
+	}
+	format := ",format=qcow2"
+	if config, err := client.storageConfig(storage); err == nil && !slices.Contains(fileStorageTypes, config.Type) {
+		format = ""
+	}
+	if importFrom := disk["import_from"].(string); importFrom != "" {
+		return diskWithOptions(fmt.Sprintf("%s:0%s,import-from=%s", storage, format, importFrom), disk)
+	}
+	return diskWithOptions(fmt.Sprintf("%s:%d%s", storage, disk["size"].(int), format), disk)
+}
+
+// diskWithOptions returns the disk config value with the options of disk block applied.
+func diskWithOptions(value string, disk map[string]interface{}) string {
+	l := parsePropertyList(value, "file")
+	for _, flag := range []string{"backup", "replicate"} {
+		if disk[flag].(bool) {
+			l.Delete(flag)
+		} else {
+			l.Set(flag, "0")
+		}
+	}
+	if disk["shared"].(bool) {
+		l.Set("shared", "1")
+	} else {
+		l.Delete("shared")
+	}
+	return l.String()
+}
+
+// agentConfig is the parsed agent config of a vm, with pve defaults filled in.
+type agentConfig struct {
+	Enabled           bool
+	Type              string
+	FstrimClonedDisks bool
+	FreezeFSOnBackup  bool
+}
+
+// parseAgent parses the agent config of vm, which is either the shorthand "1" or a property
+// string like "enabled=1,fstrim_cloned_disks=1".
+func parseAgent(vmConfig map[string]interface{}) agentConfig {
+	value := ""
+	switch v := vmConfig["agent"].(type) {
+	case string:
+		value = v
+	case float64:
+		value = strconv.Itoa(int(v))
+	}
+	l := parsePropertyList(value, "enabled")
+	enabled, _ := l.Get("enabled")
+	agentType, ok := l.Get("type")
+	if !ok {
+		agentType = "virtio"
+	}
+	fstrim, _ := l.Get("fstrim_cloned_disks")
+	freeze, _ := l.Get("freeze-fs-on-backup")
+	return agentConfig{
+		Enabled:           enabled == "1",
+		Type:              agentType,
+		FstrimClonedDisks: fstrim == "1",
+		FreezeFSOnBackup:  freeze != "0",
+	}
+}
+
+// block returns a as value of the agent block.
+func (a agentConfig) block() map[string]interface{} {
+	return map[string]interface{}{
+		"enabled":             a.Enabled,
+		"type":                a.Type,
+		"fstrim_cloned_disks": a.FstrimClonedDisks,
+		"freeze_fs_on_backup": a.FreezeFSOnBackup,
+	}
+}
+
+// agentWithOptions builds the agent config value from an agent block, options at pve defaults are left out.
+func agentWithOptions(agent map[string]interface{}) string {
+	l := parsePropertyList("", "enabled")
+	if agent["enabled"].(bool) {
+		l.Set("enabled", "1")
+	} else {
+		l.Set("enabled", "0")
+	}
+	if agent["fstrim_cloned_disks"].(bool) {
+		l.Set("fstrim_cloned_disks", "1")
+	}
+	if !agent["freeze_fs_on_backup"].(bool) {
+		l.Set("freeze-fs-on-backup", "0")
+	}
+	if t := agent["type"].(string); t != "virtio" {
+		l.Set("type", t)
+	}
+	return l.String()
+}
+
+// usesCloudInit reports whether any attribute configured for d is carried out by cloud-init.
+func usesCloudInit(d *schema.ResourceData) bool {
+	for _, k := range []string{"user_data", "timezone", "ci_password_hash", "cloud_init_drive"} {
+		if _, ok := d.GetOk(k); ok {
+			return true
+		}
+	}
+	return d.Get("ci_upgrade").(bool) || customHostname(d) != ""
+}
+
+// customHostname returns the hostname configured for d when it differs from name, otherwise "".
+func customHostname(d *schema.ResourceData) string {
+	if hostname := d.Get("hostname").(string); hostname != "" && hostname != d.Get("name").(string) {
+		return hostname
+	}
+	return ""
+}
+
+// withoutHostname removes the hostname and fqdn pve puts into the user data it generates.
+func withoutHostname(userData string) string {
+	lines := strings.SplitAfter(userData, "\n")
+	result := lines[:0]
+	for _, line := range lines {
+		if strings.HasPrefix(line, "hostname:") || strings.HasPrefix(line, "fqdn:") {
+			continue
+		}
+		result = append(result, line)
+	}
+	return strings.Join(result, "")
+}
+
+// cloudInitDriveValue returns the value of the cloud-init drive to create for d.
+func cloudInitDriveValue(d *schema.ResourceData) string {
+	value := d.Get("target_storage").(string) + ":cloudinit"
+	if drive, ok := d.GetOk("cloud_init_drive"); ok && drive.([]interface{})[0] != nil {
+		m := drive.([]interface{})[0].(map[string]interface{})
+		if m["storage"] != "" {
+			value = m["storage"].(string) + ":cloudinit"
+		}
+		if m["format"] != "" {
+			value += ",format=" + m["format"].(string)
+		}
+	}
+	return value
+}
+
+// fileStorageTypes are the storage types keeping images as files, the others only take raw images.
+var fileStorageTypes = []string{"dir", "nfs", "cifs", "glusterfs", "cephfs", "btrfs"}
+
+// checkCloudInitDrive checks storage of the cloud_init_drive block of d takes disk images of its format.
+// It's skipped when the storage can't be read, eg. without Datastore.Audit.
+func checkCloudInitDrive(ctx context.Context, client *apiClient, d *schema.ResourceDiff) error {
+	m, _ := d.Get("cloud_init_drive").([]interface{})[0].(map[string]interface{})
+	if m == nil {
+		return nil
+	}
+	storage := m["storage"].(string)
+	if storage == "" {
+		storage = d.Get("target_storage").(string)
+	}
+	config, err := client.storageConfig(storage)
+	if err != nil {
+		tflog.Warn(ctx, "skip checking cloud init drive storage", map[string]interface{}{"storage": storage, "err": err.Error()})
+		return nil
+	}
+	if !slices.Contains(config.Content, "images") {
+		return fmt.Errorf("cloud_init_drive storage %s doesn't allow disk images, allowed content: %s", storage, strings.Join(config.Content, ", "))
+	}
+	if format := m["format"].(string); format != "" && format != "raw" && !slices.Contains(fileStorageTypes, config.Type) {
+		return fmt.Errorf("cloud_init_drive format %s isn't supported by storage %s of type %s, which only takes raw", format, storage, config.Type)
+	}
+	return nil
+}
+
+var cloudInitVolumeRegexp = regexp.MustCompile(`vm-\d+-cloudinit`)
+
+var volumeOwnerRegexp = regexp.MustCompile(`^[^:]+:(?:\d+/)?(?:vm|base)-(\d+)-`)
+
+// volumeOwner returns the id of the vm volid is named after, or 0 for a volume not named after a vm.
+func volumeOwner(volid string) int {
+	match := volumeOwnerRegexp.FindStringSubmatch(volid)
+	if match == nil {
+		return 0
+	}
+	vmid, _ := strconv.Atoi(match[1])
+	return vmid
+}
+
+// cloudInitDrive returns the device the cloud-init drive of vm is attached to.
+func cloudInitDrive(vmConfig map[string]interface{}) (string, bool) {
+	devices := []string{}
+	for k := range vmConfig {
+		if diskDeviceRegexp.MatchString(k) {
+			devices = append(devices, k)
+		}
+	}
+	sort.Strings(devices)
+	for _, device := range devices {
+		value, _ := vmConfig[device].(string)
+		file, _ := parsePropertyList(value, "file").Get("file")
+		if strings.HasSuffix(file, ":cloudinit") || cloudInitVolumeRegexp.MatchString(file) {
+			return device, true
+		}
+	}
+	return "", false
+}
+
+// parseVGA returns the vga config of vm as value of the vga block, pve defaults to std.
+func parseVGA(vmConfig map[string]interface{}) map[string]interface{} {
+	value, _ := vmConfig["vga"].(string)
+	l := parsePropertyList(value, "type")
+	vgaType, ok := l.Get("type")
+	if !ok {
+		vgaType = "std"
+	}
+	memory, _ := l.Get("memory")
+	memoryMB, _ := strconv.Atoi(memory)
+	return map[string]interface{}{
+		"type":   vgaType,
+		"memory": memoryMB,
+	}
+}
+
+// vgaWithOptions builds the vga config value from a vga block.
+func vgaWithOptions(vga map[string]interface{}) string {
+	l := parsePropertyList("", "type")
+	l.Set("type", vga["type"].(string))
+	if memory := vga["memory"].(int); memory > 0 {
+		l.Set("memory", strconv.Itoa(memory))
+	}
+	return l.String()
+}
+
+// parseRNG returns the rng0 config of vm as value of the rng block.
+func parseRNG(vmConfig map[string]interface{}) (map[string]interface{}, bool) {
+	value, ok := vmConfig["rng0"].(string)
+	if !ok {
+		return nil, false
+	}
+	l := parsePropertyList(value, "source")
+	source, _ := l.Get("source")
+	maxBytes, period := 1024, 1000
+	if v, ok := l.Get("max_bytes"); ok {
+		maxBytes, _ = strconv.Atoi(v)
+	}
+	if v, ok := l.Get("period"); ok {
+		period, _ = strconv.Atoi(v)
+	}
+	return map[string]interface{}{
+		"source":    source,
+		"max_bytes": maxBytes,
+		"period":    period,
+	}, true
+}
+
+// rngWithOptions builds the rng0 config value from a rng block, options at pve defaults are left out.
+func rngWithOptions(rng map[string]interface{}) string {
+	l := parsePropertyList("", "source")
+	l.Set("source", rng["source"].(string))
+	if maxBytes := rng["max_bytes"].(int); maxBytes != 1024 {
+		l.Set("max_bytes", strconv.Itoa(maxBytes))
+	}
+	if period := rng["period"].(int); period != 1000 {
+		l.Set("period", strconv.Itoa(period))
+	}
+	return l.String()
+}
+
+// parseHostPCI returns the hostpciN config of vm as value of the hostpci blocks, ordered by N.
+func parseHostPCI(vmConfig map[string]interface{}) []interface{} {
+	devs := []interface{}{}
+	for i := 0; i < 16; i++ {
+		value, ok := vmConfig[fmt.Sprintf("hostpci%d", i)].(string)
+		if !ok {
+			continue
+		}
+		l := parsePropertyList(value, "host")
+		host, _ := l.Get("host")
+		mdev, _ := l.Get("mdev")
+		pcie, _ := l.Get("pcie")
+		rombar, _ := l.Get("rombar")
+		devs = append(devs, map[string]interface{}{
+			"host":   host,
+			"mdev":   mdev,
+			"pcie":   pcie == "1",
+			"rombar": rombar != "0",
+		})
+	}
+	return devs
+}
+
+// hostPCIWithOptions builds the hostpciN config value from a hostpci block, options at pve
+// defaults are left out.
+func hostPCIWithOptions(dev map[string]interface{}) string {
+	l := parsePropertyList("", "host")
+	l.Set("host", dev["host"].(string))
+	if mdev := dev["mdev"].(string); mdev != "" {
+		l.Set("mdev", mdev)
+	}
+	if dev["pcie"].(bool) {
+		l.Set("pcie", "1")
+	}
+	if !dev["rombar"].(bool) {
+		l.Set("rombar", "0")
+	}
+	return l.String()
+}
+
+// checkMdevs checks the host device of each hostpci block with a mdev supports that mediated
+// device type on node.
+func checkMdevs(ctx context.Context, client *apiClient, node string, d *schema.ResourceDiff) error {
+	for i, dev := range d.Get("hostpci").([]interface{}) {
+		dev := dev.(map[string]interface{})
+		mdev := dev["mdev"].(string)
+		if mdev == "" || !d.NewValueKnown(fmt.Sprintf("hostpci.%d.host", i)) || !d.NewValueKnown(fmt.Sprintf("hostpci.%d.mdev", i)) {
+			continue
+		}
+		host := dev["host"].(string)
+		types, err := client.listMdevTypes(node, host)
+		if err != nil {
+			tflog.Warn(ctx, "skip checking mediated device type", map[string]interface{}{"node": node, "host": host, "err": err.Error()})
+			continue
+		}
+		if len(types) == 0 {
+			return fmt.Errorf("hostpci.%d.host %s of node %s doesn't support mediated devices", i, host, node)
+		}
+		if !slices.Contains(types, mdev) {
+			return fmt.Errorf("hostpci.%d.mdev %q isn't supported by %s of node %s, available: %s", i, mdev, host, node, strings.Join(types, ", "))
+		}
+	}
+	return nil
+}
+
+// vmMemory returns memory and balloon minimum in MB as configured for vm. Unlike the balloon of
+// the vm status, they don't follow the memory the balloon device currently takes from the guest.
+func vmMemory(vmConfig map[string]interface{}) (memory, balloon int) {
+	if v, ok := vmConfig["memory"].(float64); ok {
+		memory = int(v)
+	}
+	if v, ok := vmConfig["balloon"].(float64); ok {
+		balloon = int(v)
+	} else {
+		// pve default
+		balloon = memory
+	}
+	return memory, balloon
+}
+
+// balloonWarnings warns about balloon and memory_shares configured to no effect. Auto-ballooning
+// only moves the memory of a vm between its balloon minimum and memory, so it's inactive for a vm
+// whose minimum is memory or without balloon device. balloonSet and sharesSet tell whether those
+// are configured.
+func balloonWarnings(vmConfig map[string]interface{}, balloonSet, sharesSet bool) diag.Diagnostics {
+	memory, balloon := vmMemory(vmConfig)
+	var diags diag.Diagnostics
+	if balloonSet && balloon == memory {
+		diags = append(diags, diag.Diagnostic{
+			Severity: diag.Warning,
+			Summary:  fmt.Sprintf("balloon %d equals memory, auto-ballooning never shrinks the vm", balloon),
+			Detail:   "Set balloon lower than memory for a memory floor, or to 0 to remove the balloon device.",
+		})
+	}
+	if sharesSet && (balloon == 0 || balloon >= memory) {
+		diags = append(diags, diag.Diagnostic{
+			Severity: diag.Warning,
+			Summary:  "memory_shares has no effect while auto-ballooning is inactive for the vm",
+			Detail:   "Shares only matter when balloon is set lower than memory.",
+		})
+	}
+	return diags
+}
+
+// vmMeta returns the properties of the meta config of vm, eg. "creation-qemu=6.1.0,ctime=1646894084".
+func vmMeta(vmConfig map[string]interface{}) map[string]interface{} {
+	value, _ := vmConfig["meta"].(string)
+	meta := map[string]interface{}{}
+	for _, p := range parsePropertyList(value, "").props {
+		meta[p.key] = p.value
+	}
+	return meta
+}
+
+// vmACLPath returns the acl path of vm vmid.
+func vmACLPath(vmid int) string {
+	return fmt.Sprintf("/vms/%d", vmid)
+}
+
+// aclEntries converts the acl blocks of a vm into acl entries.
+func aclEntries(acl *schema.Set) []aclEntry {
+	entries := make([]aclEntry, 0, acl.Len())
+	for _, v := range acl.List() {
+		v := v.(map[string]interface{})
+		entries = append(entries, aclEntry{Type: v["type"].(string), ID: v["id"].(string), Role: v["role"].(string)})
+	}
+	return entries
+}
+
+// aclValue converts acl entries into the value of the acl attribute.
+func aclValue(entries []aclEntry) []interface{} {
+	value := make([]interface{}, 0, len(entries))
+	for _, e := range entries {
+		value = append(value, map[string]interface{}{"type": e.Type, "id": e.ID, "role": e.Role})
+	}
+	return value
+}
+
+// vmCores returns number of cpu cores per socket of vm, pve defaults to 1.
+func vmCores(vmConfig map[string]interface{}) int {
+	if cores, ok := vmConfig["cores"].(float64); ok {
+		return int(cores)
+	}
+	return 1
+}
+
+// vmSockets returns number of cpu sockets of vm, pve defaults to 1.
+func vmSockets(vmConfig map[string]interface{}) int {
+	if sockets, ok := vmConfig["sockets"].(float64); ok {
+		return int(sockets)
+	}
+	return 1
+}
+
+// checkVCPUs checks vcpus doesn't exceed the vcpus the vm has with cores per socket.
+func checkVCPUs(sockets, cores, vcpus int) error {
+	if max := sockets * cores; vcpus > max {
+		return fmt.Errorf("vcpus %d exceeds %d sockets * %d cores of the vm", vcpus, sockets, cores)
+	}
+	return nil
+}
+
+// hotplugValue builds the hotplug config value, where "0" disables all hotplug features.
+func hotplugValue(set *schema.Set) string {
+	if set.Len() == 0 {
+		return "0"
+	}
+	features := expandStringList(set.List())
+	sort.Strings(features)
+	return strings.Join(features, ",")
+}
+
+// smbiosWithUUID returns the smbios1 config value of vm with a newly generated uuid, keeping
+// its other smbios settings.
+func smbiosWithUUID(vmConfig map[string]interface{}) (string, error) {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return "", err
+	}
+	smbios, _ := vmConfig["smbios1"].(string)
+	l := parsePropertyList(smbios, "")
+	l.Set("uuid", id)
+	return l.String(), nil
+}
+
+// vmUUID returns the smbios uuid from vm config, or empty string if not set.
+func vmUUID(vmConfig map[string]interface{}) string {
+	smbios, _ := vmConfig["smbios1"].(string)
+	uuid, _ := parsePropertyList(smbios, "").Get("uuid")
+	return uuid
+}
+
+// cpuWithFlags returns the cpu config value with its flags replaced, other cpu options are kept.
+func cpuWithFlags(cpu string, flags []string) string {
+	l := parsePropertyList(cpu, "cputype")
+	if _, ok := l.Get("cputype"); !ok {
+		// pve default cpu type
+		l.Set("cputype", "kvm64")
+	}
+	if len(flags) == 0 {
+		l.Delete("flags")
+	} else {
+		l.Set("flags", strings.Join(flags, ";"))
+	}
+	return l.String()
+}
+
+// cpuWithType returns the cpu config value with its cpu type replaced, other cpu options are kept.
+func cpuWithType(cpu, cpuType string) string {
+	l := parsePropertyList(cpu, "cputype")
+	l.Set("cputype", cpuType)
+	return l.String()
+}
+
+func expandStringList(v []interface{}) []string {
+	l := make([]string, len(v))
+	for i, s := range v {
+		l[i] = s.(string)
+	}
+	return l
+}
+
+func resourceVMUpdate(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client, err := meta.(*apiClient).forEndpoint(d.Get("endpoint").(string))
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	vmid, err := strconv.Atoi(d.Id())
+	if err != nil {
+		return diag.Errorf("faild to convert resource id to vmid: %s", err)
+	}
+
+	// changes are collected into updates and applied by a single SetVmConfig, changes pending
+	// until a restart only set shutdownNeeded, so the vm is restarted at most once below
+	shutdownNeeded := false
+	// acpi setting the vm is currently running with, it decides how the vm can be shutdown
+	runningACPI, _ := d.GetChange("acpi")
+
+	// the new vm is created with the whole config, so there's nothing left to update
+	if d.HasChange("template_name") && d.Get("template_switch_strategy") == "blue_green" {
+		return switchTemplateBlueGreen(ctx, client, d, meta)
+	}
+
+	vmref := pxapi.NewVmRef(vmid)
+	if err := client.CheckVmRef(vmref); err != nil {
+		return diag.Errorf("failed to check vm: %s", err)
+	}
+
+	updates := map[string]interface{}{}
+	// config keys to reset, sent along with updates
+	deleteKeys := []string{}
+
+	if d.HasChange("name") {
+		updates["name"] = d.Get("name")
+	}
+
+	if d.HasChange("cores") {
+		cores := d.Get("cores")
+		updates["cores"] = cores
+		shutdownNeeded = true
+	}
+	if d.HasChange("memory") {
+		memory := d.Get("memory")
+		updates["memory"] = memory
+		shutdownNeeded = true
+	}
+	if d.HasChange("balloon") && !d.GetRawConfig().GetAttr("balloon").IsNull() {
+		// the balloon target is changed live, only adding or removing the device needs a restart
+		oldBalloon, newBalloon := d.GetChange("balloon")
+		updates["balloon"] = newBalloon
+		if oldBalloon.(int) == 0 || newBalloon.(int) == 0 {
+			shutdownNeeded = true
+		}
+	}
+	if d.HasChange("sockets") {
+		updates["sockets"] = d.Get("sockets")
+		shutdownNeeded = true
+	}
+	if d.HasChange("vcpus") && !d.GetRawConfig().GetAttr("vcpus").IsNull() {
+		updates["vcpus"] = d.Get("vcpus")
+		// vcpus go online or offline live only with cpu hotplug
+		oldHotplug, newHotplug := d.GetChange("hotplug")
+		if !oldHotplug.(*schema.Set).Contains("cpu") || !newHotplug.(*schema.Set).Contains("cpu") {
+			shutdownNeeded = true
+		}
+	}
+	if d.HasChange("onboot") {
+		onboot := d.Get("onboot")
+		updates["onboot"] = onboot
+	}
+	if d.HasChange("protection") {
+		updates["protection"] = d.Get("protection")
+	}
+	if d.HasChange("pool") {
+		pool := d.Get("pool").(string)
+		if err := client.moveToPool(vmid, vmref.Pool(), pool); err != nil {
+			return diag.Errorf("failed to move vm from pool %q to pool %q: %s", vmref.Pool(), pool, err)
+		}
+		tflog.Debug(ctx, "vm moved to pool", map[string]interface{}{"vmid": vmid, "from": vmref.Pool(), "to": pool})
+	}
+	if d.HasChange("tags") {
+		if tags := vmTags(client, d); len(tags) > 0 {
+			updates["tags"] = strings.Join(tags, ";")
+		} else {
+			deleteKeys = append(deleteKeys, "tags")
+		}
+	}
+	if d.HasChange("description") {
+		if description := d.Get("description").(string); description != "" {
+			updates["description"] = description
+		} else {
+			deleteKeys = append(deleteKeys, "description")
+		}
+	}
+	if d.HasChange("agent") {
+		if agent := d.Get("agent").([]interface{}); len(agent) > 0 {
+			updates["agent"] = agentWithOptions(agent[0].(map[string]interface{}))
+			shutdownNeeded = true
+		}
+	}
+	if d.HasChange("vga") {
+		if vga := d.Get("vga").([]interface{}); len(vga) > 0 {
+			updates["vga"] = vgaWithOptions(vga[0].(map[string]interface{}))
+			shutdownNeeded = true
+		}
+	}
+	if d.HasChange("rng") {
+		if rng := d.Get("rng").([]interface{}); len(rng) > 0 {
+			updates["rng0"] = rngWithOptions(rng[0].(map[string]interface{}))
+			shutdownNeeded = true
+		}
+	}
+	if d.HasChange("hostpci") {
+		oldDevs, newDevs := d.GetChange("hostpci")
+		for i, dev := range newDevs.([]interface{}) {
+			updates[fmt.Sprintf("hostpci%d", i)] = hostPCIWithOptions(dev.(map[string]interface{}))
+		}
+		for i := len(newDevs.([]interface{})); i < len(oldDevs.([]interface{})); i++ {
+			deleteKeys = append(deleteKeys, fmt.Sprintf("hostpci%d", i))
+		}
+		shutdownNeeded = true
+	}
+	if d.HasChange("acpi") {
+		updates["acpi"] = d.Get("acpi")
+		shutdownNeeded = true
+	}
+	// the snippet is written over in place, pve only picks up the change once it regenerates
+	// the cloud-init drive, which cloud-init reads at boot
+	regenerateCloudInit := false
+	if d.HasChange("ci_password_hash") {
+		if hash := d.Get("ci_password_hash").(string); hash != "" {
+			updates["cipassword"] = hash
+		} else {
+			deleteKeys = append(deleteKeys, "cipassword")
+		}
+		regenerateCloudInit = true
+		shutdownNeeded = true
+	}
+	if d.HasChange("ci_upgrade") {
+		if err := client.checkVersion(8, 1, "ci_upgrade"); err != nil {
+			return diag.FromErr(err)
+		}
+		updates["ciupgrade"] = d.Get("ci_upgrade")
+		// upgrading only happens on boot, so the running vm isn't restarted for it
+		regenerateCloudInit = true
+	}
+	if d.HasChange("user_data") {
+		snippetName := fmt.Sprintf("vm-%d-cloudinit-user-data", vmid)
+		if diags := writeSnippet(ctx, client, vmref, d.Get("snippet_storage").(string), snippetName, d.Get("user_data").(string), "user_data"); diags != nil {
+			return diags
+		}
+		regenerateCloudInit = true
+		shutdownNeeded = true
+	}
+	if d.HasChange("cicustom") {
+		if cicustom := d.Get("cicustom").(string); cicustom != "" {
+			updates["cicustom"] = cicustom
+		} else {
+			deleteKeys = append(deleteKeys, "cicustom")
+		}
+		regenerateCloudInit = true
+	}
+	if d.HasChange("memory_shares") {
+		updates["shares"] = d.Get("memory_shares")
+	}
+	if d.HasChange("hotplug") {
+		updates["hotplug"] = hotplugValue(d.Get("hotplug").(*schema.Set))
+	}
+	if d.HasChange("cpu_flags") || (d.HasChange("cpu_type") && !d.GetRawConfig().GetAttr("cpu_type").IsNull()) {
+		vmConfig, err := client.GetVmConfig(vmref)
+		if err != nil {
+			return diag.Errorf("failed to get vm config: %s", err)
+		}
+		cpu, _ := vmConfig["cpu"].(string)
+		if !d.GetRawConfig().GetAttr("cpu_type").IsNull() {
+			cpu = cpuWithType(cpu, d.Get("cpu_type").(string))
+		}
+		updates["cpu"] = cpuWithFlags(cpu, expandStringList(d.Get("cpu_flags").([]interface{})))
+		shutdownNeeded = true
+	}
+	hotpluggedNICs := []string{}
+	if d.HasChange("network") {
+		oldNICs, newNICs := d.GetChange("network")
+		oldHotplug, newHotplug := d.GetChange("hotplug")
+		networkHotplug := oldHotplug.(*schema.Set).Contains("network") && newHotplug.(*schema.Set).Contains("network")
+		vmConfig, err := client.GetVmConfig(vmref)
+		if err != nil {
+			return diag.Errorf("failed to get vm config: %s", err)
+		}
+		for i, nic := range newNICs.([]interface{}) {
+			device := fmt.Sprintf("net%d", i)
+			current, _ := vmConfig[device].(string)
+			value := nicWithOptions(current, nic.(map[string]interface{}))
+			if value == current {
+				continue
+			}
+			updates[device] = value
+			// without network hotplug pve leaves any change of a nic pending until the vm restarts
+			if !networkHotplug {
+				shutdownNeeded = true
+				continue
+			}
+			if i >= len(oldNICs.([]interface{})) {
+				// add network interface, it's attached live
+				hotpluggedNICs = append(hotpluggedNICs, device)
+				continue
+			}
+			oldNIC := oldNICs.([]interface{})[i].(map[string]interface{})
+			for _, k := range []string{"mtu", "queues"} {
+				if oldNIC[k] != nic.(map[string]interface{})[k] {
+					shutdownNeeded = true
+				}
+			}
+		}
+		for i := len(newNICs.([]interface{})); i < len(oldNICs.([]interface{})); i++ {
+			deleteKeys = append(deleteKeys, fmt.Sprintf("net%d", i))
+			if !networkHotplug {
+				shutdownNeeded = true
+			}
+		}
+	}
+	if d.HasChange("disk") {
+		oldDisks, newDisks := d.GetChange("disk")
+		oldDevices, newDevices := diskDevices(oldDisks.([]interface{})), diskDevices(newDisks.([]interface{}))
+		// update options of existing disk
+		var vmConfig map[string]interface{}
+		for i := 0; i < len(oldDisks.([]interface{})) && i < len(newDisks.([]interface{})); i++ {
+			oldDisk := oldDisks.([]interface{})[i].(map[string]interface{})
+			newDisk := newDisks.([]interface{})[i].(map[string]interface{})
+			if storage := newDisk["storage"].(string); storage != oldDisk["storage"] && storage != "" && oldDisk["storage"] != "" && newDisk["volid"] == "" {
+				tflog.Debug(ctx, "move disk", map[string]interface{}{"device": newDevices[i], "storage": storage})
+				if _, err := client.moveQemuDisk(vmref, map[string]interface{}{
+					"disk":    newDevices[i],
+					"storage": storage,
+					"delete":  true,
+				}); err != nil {
+					return diag.Errorf("failed to move disk %s to storage %s: %s", newDevices[i], storage, err)
+				}
+				// the volume of the disk changed
+				vmConfig = nil
+			}
+			if size := newDisk["size"].(int); size > oldDisk["size"].(int) && oldDisk["size"].(int) > 0 {
+				tflog.Debug(ctx, "resize disk", map[string]interface{}{"device": newDevices[i], "size": size})
+				if _, err := client.ResizeQemuDiskRaw(vmref, newDevices[i], fmt.Sprintf("%dG", size)); err != nil {
+					return diag.Errorf("failed to resize disk %s: %s", newDevices[i], err)
+				}
+			}
+			if oldDisk["backup"] == newDisk["backup"] && oldDisk["replicate"] == newDisk["replicate"] && oldDisk["shared"] == newDisk["shared"] {
+				continue
+			}
+			if vmConfig == nil {
+				vmConfig, err = client.GetVmConfig(vmref)
+				if err != nil {
+					return diag.Errorf("failed to get vm config: %s", err)
+				}
+			}
+			device := newDevices[i]
+			current, _ := vmConfig[device].(string)
+			updates[device] = diskWithOptions(current, newDisk)
+		}
+		if len(oldDisks.([]interface{})) < len(newDisks.([]interface{})) {
+			// add disk, it's attached live when disk hotplug stays enabled, otherwise only after a restart
+			oldHotplug, newHotplug := d.GetChange("hotplug")
+			if !oldHotplug.(*schema.Set).Contains("disk") || !newHotplug.(*schema.Set).Contains("disk") {
+				shutdownNeeded = true
+			}
+			for i := len(oldDisks.([]interface{})); i < len(newDisks.([]interface{})); i++ {
+				disk := newDisks.([]interface{})[i].(map[string]interface{})
+				// qemu can't hotplug sata disks
+				if disk["type"] == "sata" {
+					shutdownNeeded = true
+				}
+				updates[newDevices[i]] = newDiskValue(client, disk, d.Get("target_storage").(string))
+			}
+		} else if len(oldDisks.([]interface{})) > len(newDisks.([]interface{})) {
+			// remove disk, volumes attached by volid are only detached
+			vmConfig, err := client.GetVmConfig(vmref)
+			if err != nil {
+				return diag.Errorf("failed to get vm config: %s", err)
+			}
+			deletes := []string{}
+			owned := map[string]bool{}
+			for i := len(newDisks.([]interface{})); i < len(oldDisks.([]interface{})); i++ {
+				device := oldDevices[i]
+				deletes = append(deletes, device)
+				if oldDisks.([]interface{})[i].(map[string]interface{})["volid"] == "" {
+					current, _ := vmConfig[device].(string)
+					file, _ := parsePropertyList(current, "file").Get("file")
+					owned[file] = true
+				}
+			}
+			if err := detachDisks(client, vmref, deletes, owned); err != nil {
+				return diag.FromErr(err)
+			}
+		}
+	}
+
+	if len(deleteKeys) > 0 {
+		updates["delete"] = strings.Join(deleteKeys, ",")
+	}
+	if len(updates) > 0 {
 		if err := client.CheckVmRef(vmref); err != nil {
 			return diag.Errorf("failed to check vm: %s", err)
 		}
+		if err := client.setVmConfig(ctx, vmref, updates, d.Timeout(schema.TimeoutUpdate)); err != nil {
+			return diag.Errorf("failed to update config: %s", err)
+		}
+	}
+	// older pve regenerate the drive only when the vm starts, which the restart below does
+	if regenerateCloudInit && client.checkVersion(7, 2, "regenerating the cloud-init drive") == nil {
+		tflog.Debug(ctx, "regenerate cloud-init drive", map[string]interface{}{"vmid": vmid})
+		if err := client.regenerateCloudInit(vmref); err != nil {
+			return diag.Errorf("failed to regenerate cloud-init drive: %s", err)
+		}
+	}
+
+	if d.HasChange("template_name") {
+		tplrefs, err := client.GetVmRefsByName(d.Get("template_name").(string))
+		if err != nil {
+			return diag.FromErr(err)
+		}
+
+		if len(tplrefs) == 0 {
+			return diag.Errorf("template not found")
+		} else if len(tplrefs) > 1 {
+			return diag.Errorf("found multiple template with same template_name")
+		}
+
+		tplref := tplrefs[0]
+		if tplref.GetVmType() != "qemu" {
+			return diag.Errorf("template is not for qemu vm")
+		}
+
+		if err := shutdownForRestart(ctx, client, vmref, d.Get("reboot_timeout").(int), runningACPI.(bool), d.Timeout(schema.TimeoutUpdate)); err != nil {
+			return diag.FromErr(err)
+		}
+
+		// settings given in the config win over the ones of the new template
+		keep := []string{}
+		if vga := d.GetRawConfig().GetAttr("vga"); !vga.IsNull() && vga.LengthInt() > 0 {
+			keep = append(keep, "vga")
+		}
+		if !d.GetRawConfig().GetAttr("cpu_type").IsNull() {
+			keep = append(keep, "cpu")
+		}
+		if err := replaceTemplate(ctx, client, d.Get("name").(string), vmref, tplref, d.Get("full_clone").(bool), d.Get("target_storage").(string), keep, d.Timeout(schema.TimeoutUpdate)); err != nil {
+			return diag.Errorf("failed to replace template: %s", err)
+		}
+		d.Set("source_template", sourceTemplateValue(d.Get("template_name").(string), tplref))
+
+		shutdownNeeded = false
+	}
+
+	if d.HasChange("acl") {
+		oldACL, newACL := d.GetChange("acl")
+		for _, entry := range aclEntries(oldACL.(*schema.Set).Difference(newACL.(*schema.Set))) {
+			if err := client.updateACL(vmACLPath(vmid), entry, true); err != nil {
+				return diag.Errorf("failed to revoke role %s from %s %s: %s", entry.Role, entry.Type, entry.ID, err)
+			}
+		}
+		for _, entry := range aclEntries(newACL.(*schema.Set).Difference(oldACL.(*schema.Set))) {
+			if err := client.updateACL(vmACLPath(vmid), entry, false); err != nil {
+				return diag.Errorf("failed to grant role %s to %s %s: %s", entry.Role, entry.Type, entry.ID, err)
+			}
+		}
+	}
+
+	if shutdownNeeded {
+		if err := shutdownForRestart(ctx, client, vmref, d.Get("reboot_timeout").(int), runningACPI.(bool), d.Timeout(schema.TimeoutUpdate)); err != nil {
+			return diag.FromErr(err)
+		}
+	}
+
+	vmState, err := client.GetVmState(vmref)
+	if err != nil {
+		return diag.Errorf("failed to get vm state: %s", err)
+	}
+	currentStatus := vmStatus(vmState)
+	desiredStatus := d.Get("status").(string)
+	// a vm not restarted above still runs with the acpi setting from before
+	acpi := d.Get("acpi").(bool)
+	if !shutdownNeeded {
+		acpi = runningACPI.(bool)
+	}
+
+	switch currentStatus {
+	case "running":
+		switch desiredStatus {
+		case "running":
+			// a vm restarted above is already fresh, so only reset when it kept running
+			if d.HasChange("reset_trigger") {
+				tflog.Debug(ctx, "reset vm", map[string]interface{}{"vmid": vmref.VmId()})
+				if _, err := client.ResetVm(vmref); err != nil {
+					return diag.Errorf("failed to reset vm: %s", err)
+				}
+			} else if len(hotpluggedNICs) > 0 && !shutdownNeeded {
+				vmConfig, err := client.GetVmConfig(vmref)
+				if err != nil {
+					return diag.Errorf("failed to get vm config: %s", err)
+				}
+				if parseAgent(vmConfig).Enabled && !client.skipIPWait {
+					if err := waitAgentNICs(ctx, client, vmref, vmConfig, hotpluggedNICs, d.Timeout(schema.TimeoutUpdate)); err != nil {
+						return diag.Errorf("wait guest to see hotplugged network interface: %s", err)
+					}
+				}
+			}
+		case "stopped":
+			if err := shutdownOrStopVM(ctx, client, vmref, acpi); err != nil {
+				return diag.Errorf("failed to shutdown vm: %s", err)
+			}
+			if err := waitVMStopped(ctx, client, vmref, d.Timeout(schema.TimeoutUpdate)); err != nil {
+				return diag.Errorf("wait vm stopped: %s", err)
+			}
+		case "paused":
+			if _, err := client.SuspendVm(vmref); err != nil {
+				return diag.Errorf("failed to pause vm: %s", err)
+			}
+		default:
+			return diag.Errorf("invalid status %q", desiredStatus)
+		}
+	case "paused":
+		switch desiredStatus {
+		case "running":
+			if _, err := client.ResumeVm(vmref); err != nil {
+				return diag.Errorf("failed to resume vm: %s", err)
+			}
+		case "stopped":
+			// the guest can only shutdown gracefully while running
+			if _, err := client.ResumeVm(vmref); err != nil {
+				return diag.Errorf("failed to resume vm: %s", err)
+			}
+			if err := shutdownOrStopVM(ctx, client, vmref, acpi); err != nil {
+				return diag.Errorf("failed to shutdown vm: %s", err)
+			}
+			if err := waitVMStopped(ctx, client, vmref, d.Timeout(schema.TimeoutUpdate)); err != nil {
+				return diag.Errorf("wait vm stopped: %s", err)
+			}
+		case "paused":
+		default:
+			return diag.Errorf("invalid status %q", desiredStatus)
+		}
+	case "stopped":
+		switch desiredStatus {
+		case "running", "paused":
+			if _, err := client.StartVm(vmref); err != nil {
+				return diag.Errorf("failed to start vm: %s", err)
+			}
+			vmConfig, err := client.GetVmConfig(vmref)
+			if err != nil {
+				return diag.Errorf("failed to get vm config: %s", err)
+			}
+			if diags := refreshVMIP(ctx, client, vmref, d, vmConfig, d.Timeout(schema.TimeoutUpdate), !client.skipIPWait, true); diags != nil {
+				return diags
+			}
+			// cloud-init runs again with the new user data
+			if regenerateCloudInit && d.Get("wait_for_cloud_init").(bool) && parseAgent(vmConfig).Enabled {
+				ciStatus, err := waitCloudInit(ctx, client, vmref, waitCloudInitTimeout)
+				d.Set("cloud_init_status", ciStatus)
+				if err != nil {
+					return diag.FromErr(err)
+				}
+			}
+			if desiredStatus == "paused" {
+				if _, err := client.SuspendVm(vmref); err != nil {
+					return diag.Errorf("failed to pause vm: %s", err)
+				}
+			}
+		case "stopped":
+		default:
+			return diag.Errorf("invalid status %q", desiredStatus)
+		}
+	default:
+		return diag.Errorf("unknown vm status %q", currentStatus)
+	}
+
+	if d.HasChanges("balloon", "memory", "memory_shares") {
+		vmConfig, err := client.GetVmConfig(vmref)
+		if err != nil {
+			return diag.Errorf("failed to get vm config: %s", err)
+		}
+		return balloonWarnings(vmConfig, !d.GetRawConfig().GetAttr("balloon").IsNull(), !d.GetRawConfig().GetAttr("memory_shares").IsNull())
+	}
+	return nil
+}
 
-		snippetName := fmt.Sprintf("vm-%d-cloudinit-user-data", vmref.VmId())
-
-		tflog.Debug(ctx, "upload snippets to local:"+snippetName)
+func resourceVMDelete(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client, err := meta.(*apiClient).forEndpoint(d.Get("endpoint").(string))
+	if err != nil {
+		return diag.FromErr(err)
+	}
 
-		encoded := base64.StdEncoding.EncodeToString([]byte(userData.(string)))
+	vmid, err := strconv.Atoi(d.Id())
+	if err != nil {
+		return diag.Errorf("faild to convert resource id to vmid: %s", err)
+	}
 
-		command := fmt.Sprintf("echo %q | base64 -d > /var/lib/vz/snippets/%s", encoded, snippetName)
+	diags := destroyVM(ctx, client, vmid, d.Get("smbios_uuid").(string), d.Get("acpi").(bool), d.Get("disk").([]interface{}), d.Get("auto_clear_protection").(bool), d.Timeout(schema.TimeoutDelete))
+	if diags.HasError() {
+		return diags
+	}
+	return append(diags, revokeVMACL(client, vmid, d.Get("acl").(*schema.Set))...)
+}
 
-		if err := executeCommandOnNode(client.session, vmref.Node(), command); err != nil {
-			return diag.Errorf("failed to configure user_data: %s", err)
+// switchTemplateBlueGreen creates a vm from the new template of d, then destroys the vm d
+// managed so far. The old vm is kept when creating the new one fails.
+func switchTemplateBlueGreen(ctx context.Context, client *apiClient, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	oldID := d.Id()
+	oldVMID, err := strconv.Atoi(oldID)
+	if err != nil {
+		return diag.Errorf("faild to convert resource id to vmid: %s", err)
+	}
+	oldUUID := d.Get("smbios_uuid").(string)
+	oldCreatedAt := d.Get("created_at").(string)
+	oldSourceTemplate := d.Get("source_template")
+	oldACPI, _ := d.GetChange("acpi")
+	oldDisks, _ := d.GetChange("disk")
+	oldAutoClear, _ := d.GetChange("auto_clear_protection")
+	// the new vm attaches the same volumes by volid, none of them goes away with the old vm
+	keptDisks := []interface{}{}
+	for _, disk := range oldDisks.([]interface{}) {
+		kept := map[string]interface{}{}
+		for k, v := range disk.(map[string]interface{}) {
+			kept[k] = v
 		}
-		updates["cicustom"] = "user=local:snippets/" + snippetName
+		kept["destroy_volume"] = false
+		keptDisks = append(keptDisks, kept)
 	}
-	if len(updates) > 0 {
-		if err := client.CheckVmRef(vmref); err != nil {
-			return diag.Errorf("failed to check vm: %s", err)
+	oldACL, _ := d.GetChange("acl")
+
+	tflog.Debug(ctx, "create vm replacing the current one", map[string]interface{}{"vmid": oldVMID})
+	if diags := resourceVMCreate(ctx, d, meta); diags.HasError() {
+		if newID := d.Id(); newID != oldID {
+			diags = append(diags, diag.Diagnostic{
+				Severity: diag.Warning,
+				Summary:  fmt.Sprintf("vm %s created for the template switch is left behind, vm %s is still managed", newID, oldID),
+			})
 		}
-		if _, err := client.SetVmConfig(vmref, updates); err != nil {
-			return diag.Errorf("failed to update cpu or memory: %s", err)
+		d.SetId(oldID)
+		d.Set("smbios_uuid", oldUUID)
+		d.Set("created_at", oldCreatedAt)
+		d.Set("source_template", oldSourceTemplate)
+		return diags
+	}
+
+	tflog.Debug(ctx, "destroy replaced vm", map[string]interface{}{"vmid": oldVMID, "new_vmid": d.Id()})
+	diags := destroyVM(ctx, client, oldVMID, oldUUID, oldACPI.(bool), keptDisks, oldAutoClear.(bool), d.Timeout(schema.TimeoutUpdate))
+	if diags.HasError() {
+		return append(diags, diag.Diagnostic{
+			Severity: diag.Warning,
+			Summary:  fmt.Sprintf("vm %d replaced by vm %s is left behind", oldVMID, d.Id()),
+		})
+	}
+	return append(diags, revokeVMACL(client, oldVMID, oldACL.(*schema.Set))...)
+}
+
+// revokeVMACL removes the acl entries granted on vm vmid once it's destroyed. Without purging
+// the vm pve keeps them, they would apply to the next vm getting the same id.
+func revokeVMACL(client *apiClient, vmid int, acl *schema.Set) diag.Diagnostics {
+	for _, entry := range aclEntries(acl) {
+		if err := client.updateACL(vmACLPath(vmid), entry, true); err != nil {
+			return diag.Errorf("failed to revoke role %s from %s %s on destroyed vm %d: %s", entry.Role, entry.Type, entry.ID, vmid, err)
 		}
 	}
+	return nil
+}
+
+// destroyVM stops and deletes vm vmid along with its snippets. It refuses a vm whose smbios
+// uuid doesn't match expectedUUID, and a protected vm unless clearProtection is set. Volumes of
+// disks attached by volid are kept unless the disk sets destroy_volume. It waits up to timeout
+// for the vm to stop.
+func destroyVM(ctx context.Context, client *apiClient, vmid int, expectedUUID string, acpi bool, disks []interface{}, clearProtection bool, timeout time.Duration) diag.Diagnostics {
+	vmref := pxapi.NewVmRef(vmid)
 
 	vmConfig, err := client.GetVmConfig(vmref)
 	if err != nil {
+		if isVMNotFound(err, vmid) {
+			tflog.Warn(ctx, "vm is already gone", map[string]interface{}{"vmid": vmid})
+			return nil
+		}
 		return diag.Errorf("failed to get vm config: %s", err)
 	}
-	vmConfigToState(vmConfig, d)
 
-	if d.Get("status") == "running" {
-		tflog.Debug(ctx, "start vm", map[string]interface{}{"vmid": vmref.VmId()})
-		_, err = client.StartVm(vmref)
-		if err != nil {
-			return diag.Errorf("failed to start vm %d: %s", vmref.VmId(), err)
+	var diags diag.Diagnostics
+	if expectedUUID == "" {
+		diags = append(diags, diag.Diagnostic{
+			Severity: diag.Warning,
+			Summary:  fmt.Sprintf("vm %d is deleted without checking it's the vm created by this resource, no smbios uuid was recorded for it", vmid),
+		})
+	} else if vmUUID(vmConfig) != expectedUUID {
+		return diag.Errorf("refusing to delete vm %d: its smbios uuid %q does not match %q recorded at creation, it is not the vm managed by this resource", vmid, vmUUID(vmConfig), expectedUUID)
+	}
+
+	if protection, _ := vmConfig["protection"].(float64); protection == 1 {
+		if !clearProtection {
+			return diag.Errorf("vm %d is protected, set protection to false or apply auto_clear_protection first to destroy it", vmid)
+		}
+		tflog.Debug(ctx, "clear protection", map[string]interface{}{"vmid": vmid})
+		if _, err := client.SetVmConfig(vmref, map[string]interface{}{"protection": false}); err != nil {
+			return diag.Errorf("failed to clear protection of vm %d: %s", vmid, err)
+		}
+	}
+
+	// pve destroys the volumes named after the vm along with it, wherever they are referenced in
+	// its config, and leaves the volumes of other vms alone
+	destroyVolumes := []string{}
+	devices := diskDevices(disks)
+	for i, disk := range disks {
+		m := disk.(map[string]interface{})
+		if m["volid"] == "" {
+			continue
+		}
+		current, _ := vmConfig[devices[i]].(string)
+		volid, _ := parsePropertyList(current, "file").Get("file")
+		if volid == "" {
+			continue
+		}
+		destroy, _ := m["destroy_volume"].(bool)
+		if volumeOwner(volid) == vmid {
+			if !destroy {
+				return diag.Errorf("refusing to delete vm %d: volume %s of disk.%d is named after the vm and would be destroyed along with it, set destroy_volume to destroy it", vmid, volid, i)
+			}
+		} else if destroy {
+			destroyVolumes = append(destroyVolumes, volid)
 		}
+	}
 
-		if agent, ok := vmConfig["agent"]; ok {
-			if agentStr, ok := agent.(string); !ok {
-				tflog.Warn(ctx, "agent parameter returned by pve is not a string, skip fetch ip address")
-			} else if strings.Contains(agentStr, "enabled=1") {
-				if diags := waitVMBootUpGetIP(ctx, client, vmref, d, waitBootUpTimeout); diags != nil {
-					return diags
-				}
+	if cicustom, ok := vmConfig["cicustom"].(string); ok && strings.TrimSpace(cicustom) != "" {
+		l := parsePropertyList(cicustom, "")
+		for _, kind := range []string{"user", "vendor", "network", "meta"} {
+			volid, ok := l.Get(kind)
+			if !ok {
+				continue
 			}
+			// snippets not named after the vm may be shared with other vms
+			storage, volume, _ := strings.Cut(volid, ":")
+			snippetName, ok := strings.CutPrefix(volume, "snippets/")
+			if !ok || !strings.HasPrefix(snippetName, fmt.Sprintf("vm-%d-cloudinit-", vmref.VmId())) {
+				continue
+			}
+			if err := deleteSnippet(ctx, client, vmref, storage, snippetName); err != nil {
+				tflog.Warn(ctx, "failed to delete snippets "+volid, map[string]interface{}{"err": err.Error()})
+			}
+		}
+	}
+
+	if err := resumeIfPaused(client, vmref); err != nil {
+		return diag.FromErr(err)
+	}
+
+	if err := shutdownOrStopVM(ctx, client, vmref, acpi); err != nil {
+		return diag.Errorf("failed to stop vm %d: %s", vmid, err)
+	}
+
+	if err := waitVMStopped(ctx, client, vmref, timeout); err != nil {
+		return diag.Errorf("wait vm stopped: %s", err)
+	}
+	tflog.Debug(ctx, "vm stopped")
+
+	_, err = client.DeleteVm(vmref)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+	tflog.Debug(ctx, "vm deleted")
+
+	for _, volid := range destroyVolumes {
+		if err := client.deleteVolume(ctx, vmref.Node(), volid, timeout); err != nil {
+			return diag.Errorf("failed to destroy volume %s of deleted vm %d: %s", volid, vmid, err)
 		}
+		tflog.Debug(ctx, "volume destroyed", map[string]interface{}{"volid": volid})
 	}
 
+	return diags
+}
+
+// shutdownOrStopVM asks the guest to shutdown, or stops the vm right away when acpi is disabled
+// since the guest would never see the request.
+func shutdownOrStopVM(ctx context.Context, client *apiClient, vmref *pxapi.VmRef, acpi bool) error {
+	if !acpi {
+		tflog.Debug(ctx, "stop vm, acpi is disabled", map[string]interface{}{"vmid": vmref.VmId()})
+		_, err := client.StopVm(vmref)
+		return err
+	}
+	tflog.Debug(ctx, "shutdown vm", map[string]interface{}{"vmid": vmref.VmId()})
+	_, err := client.ShutdownVm(vmref)
+	return err
+}
+
+// shutdownForRestart shuts down the vm so an update can start it again. With a positive
+// rebootTimeout, pve stops the vm forcibly if the guest is still running after that many seconds.
+// Without acpi the vm is stopped right away. It waits up to timeout for the vm to stop.
+func shutdownForRestart(ctx context.Context, client *apiClient, vmref *pxapi.VmRef, rebootTimeout int, acpi bool, timeout time.Duration) error {
+	if err := resumeIfPaused(client, vmref); err != nil {
+		return err
+	}
+	if !acpi {
+		if err := shutdownOrStopVM(ctx, client, vmref, false); err != nil {
+			return fmt.Errorf("failed to stop vm: %s", err)
+		}
+	} else if rebootTimeout > 0 {
+		tflog.Debug(ctx, "shutdown vm", map[string]interface{}{"vmid": vmref.VmId(), "timeout": rebootTimeout})
+		_, err := client.shutdownVm(vmref, map[string]interface{}{
+			"timeout":   rebootTimeout,
+			"forceStop": true,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to shutdown vm: %s", err)
+		}
+	} else if _, err := client.ShutdownVm(vmref); err != nil {
+		return fmt.Errorf("failed to shutdown vm: %s", err)
+	}
+	if err := waitVMStopped(ctx, client, vmref, timeout); err != nil {
+		return fmt.Errorf("wait vm stopped: %s", err)
+	}
 	return nil
 }
 
-func resourceVMRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
-	client := meta.(*apiClient)
+// waitCloudInit waits for cloud-init in the guest to write its result, and returns "done" or "error"
+// with the errors it reported.
+func waitCloudInit(ctx context.Context, client *apiClient, vmref *pxapi.VmRef, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-	vmid, err := strconv.Atoi(d.Id())
-	if err != nil {
-		return diag.Errorf("faild to convert resource id to vmid: %s", err)
+	for {
+		// the result file is only written once cloud-init finishes
+		content, err := client.agentFileRead(vmref, "/run/cloud-init/result.json")
+		if err == nil {
+			var result struct {
+				V1 struct {
+					Errors []string `json:"errors"`
+				} `json:"v1"`
+			}
+			if err := json.Unmarshal([]byte(content), &result); err != nil {
+				return "", fmt.Errorf("failed to parse cloud-init result: %s", err)
+			}
+			if len(result.V1.Errors) > 0 {
+				return "error", fmt.Errorf("cloud-init finished with errors: %s", strings.Join(result.V1.Errors, "; "))
+			}
+			return "done", nil
+		}
+
+		tflog.Trace(ctx, "cloud-init not finished", map[string]interface{}{"err": err.Error()})
+
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("timeout waiting for cloud-init to finish: %s", err)
+		case <-time.After(pollDuration):
+		}
 	}
+}
 
-	vmref := pxapi.NewVmRef(vmid)
+// waitVMConfig polls config of vm until it contains all of keys
+func waitVMConfig(ctx context.Context, client *apiClient, vmref *pxapi.VmRef, keys []string, timeout time.Duration) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-	err = client.CheckVmRef(vmref)
-	if err != nil {
-		if err.Error() == fmt.Sprintf("vm '%d' not found", vmid) {
-			d.SetId("")
-			return nil
+	for {
+		vmConfig, err := client.GetVmConfig(vmref)
+		if err != nil {
+			return nil, err
+		}
+
+		missing := []string{}
+		for _, k := range keys {
+			if _, ok := vmConfig[k]; !ok {
+				missing = append(missing, k)
+			}
+		}
+		if len(missing) == 0 {
+			return vmConfig, nil
+		}
+
+		tflog.Trace(ctx, "vm config not ready", map[string]interface{}{"missing": missing})
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("config is missing %s: %s", strings.Join(missing, ","), ctx.Err())
+		case <-time.After(pollDuration):
 		}
-		return diag.FromErr(err)
 	}
+}
 
-	vmConfig, err := client.GetVmConfig(vmref)
+var diskDeviceRegexp = regexp.MustCompile(`^(ide|sata|scsi|virtio)\d+$`)
+var nicDeviceRegexp = regexp.MustCompile(`^net\d+$`)
+
+// vmStateJSON serializes key fields of vm for state_json, fields already read into d are taken from there.
+func vmStateJSON(d *schema.ResourceData, vmid int, node string, vmConfig map[string]interface{}) (string, error) {
+	type disk struct {
+		Device string `json:"device"`
+		File   string `json:"file"`
+		Size   string `json:"size,omitempty"`
+	}
+	type nic struct {
+		Device string `json:"device"`
+		Model  string `json:"model"`
+		MAC    string `json:"mac"`
+		Bridge string `json:"bridge,omitempty"`
+	}
+	state := struct {
+		VMID        int      `json:"vmid"`
+		Name        string   `json:"name"`
+		Node        string   `json:"node"`
+		Status      string   `json:"status"`
+		IPv4Address string   `json:"ipv4_address,omitempty"`
+		IPv6Address string   `json:"ipv6_address,omitempty"`
+		IPAddresses []string `json:"ip_addresses"`
+		Disks       []disk   `json:"disks"`
+		NICs        []nic    `json:"nics"`
+	}{
+		VMID:        vmid,
+		Name:        d.Get("name").(string),
+		Node:        node,
+		Status:      d.Get("status").(string),
+		IPv4Address: d.Get("ipv4_address").(string),
+		IPv6Address: d.Get("ipv6_address").(string),
+		IPAddresses: []string{},
+		Disks:       []disk{},
+		NICs:        []nic{},
+	}
+
+	for _, iface := range d.Get("network_interfaces").([]interface{}) {
+		iface := iface.(map[string]interface{})
+		if iface["name"] == "lo" {
+			continue
+		}
+		state.IPAddresses = append(state.IPAddresses, expandStringList(iface["ip_addresses"].([]interface{}))...)
+	}
+
+	devices := make([]string, 0, len(vmConfig))
+	for k := range vmConfig {
+		devices = append(devices, k)
+	}
+	sort.Strings(devices)
+	for _, device := range devices {
+		value, ok := vmConfig[device].(string)
+		if !ok {
+			continue
+		}
+		switch {
+		case diskDeviceRegexp.MatchString(device):
+			l := parsePropertyList(value, "file")
+			if media, _ := l.Get("media"); media == "cdrom" {
+				continue
+			}
+			file, _ := l.Get("file")
+			size, _ := l.Get("size")
+			state.Disks = append(state.Disks, disk{Device: device, File: file, Size: size})
+		case nicDeviceRegexp.MatchString(device):
+			l := parsePropertyList(value, "model")
+			n := nic{Device: device}
+			for _, model := range nicModels {
+				if mac, ok := l.Get(model); ok {
+					n.Model, n.MAC = model, mac
+				}
+			}
+			n.Bridge, _ = l.Get("bridge")
+			state.NICs = append(state.NICs, n)
+		}
+	}
+
+	b, err := json.Marshal(state)
 	if err != nil {
-		return diag.Errorf("failed to get vm config: %s", err)
+		return "", err
+	}
+	return string(b), nil
+}
+
+// vmStatus returns the status of vm as used by the status attribute, pve reports a paused vm as running.
+func vmStatus(vmState map[string]interface{}) string {
+	status, _ := vmState["status"].(string)
+	if status == "running" && vmState["qmpstatus"] == "paused" {
+		return "paused"
 	}
-	vmConfigToState(vmConfig, d)
+	return status
+}
 
+// resumeIfPaused resumes a paused vm, so the guest is able to handle a shutdown request.
+func resumeIfPaused(client *apiClient, vmref *pxapi.VmRef) error {
 	vmState, err := client.GetVmState(vmref)
 	if err != nil {
-		return diag.Errorf("failed to get vm status: %s", err)
+		return fmt.Errorf("failed to get vm state: %s", err)
+	}
+	if vmStatus(vmState) == "paused" {
+		if _, err := client.ResumeVm(vmref); err != nil {
+			return fmt.Errorf("failed to resume vm: %s", err)
+		}
+	}
+	return nil
+}
+
+func waitVMStopped(ctx context.Context, client *apiClient, vmref *pxapi.VmRef, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		lock := ""
+
+		state, err := client.GetVmState(vmref)
+		if err != nil {
+			return err
+		}
+		if state["status"] == "stopped" {
+			// the task stopping the vm may still hold its lock, which fails the next operation
+			vmConfig, err := client.GetVmConfig(vmref)
+			if err != nil {
+				return err
+			}
+			if _, locked := vmConfig["lock"]; !locked {
+				break
+			}
+			lock = fmt.Sprint(vmConfig["lock"])
+			tflog.Trace(ctx, "vm stopped but locked", map[string]interface{}{"lock": lock})
+		} else {
+			tflog.Trace(ctx, "vm state", state)
+		}
+
+		select {
+		case <-ctx.Done():
+			if lock != "" {
+				return fmt.Errorf("vm is stopped but still locked (%s): %s", lock, ctx.Err())
+			}
+			return ctx.Err()
+		case <-time.After(pollDuration):
+		}
+	}
+
+	return nil
+}
+
+// refreshVMIP sets ipv4_address from the source chosen by ip_source. The guest agent is only
+// asked when waitAgent is set, waiting up to timeout for it, and for an ipv4 address as well
+// with waitIPv4.
+func refreshVMIP(ctx context.Context, client *apiClient, vmref *pxapi.VmRef, d *schema.ResourceData, vmConfig map[string]interface{}, timeout time.Duration, waitAgent, waitIPv4 bool) diag.Diagnostics {
+	source := d.Get("ip_source").(string)
+	if source != "agent" {
+		if ip, ok := configIPv4(vmConfig); ok {
+			d.Set("ipv4_address", ip)
+			return nil
+		}
+		if source == "config" {
+			d.Set("ipv4_address", "")
+			return nil
+		}
+	}
+	if !waitAgent || !parseAgent(vmConfig).Enabled {
+		return nil
+	}
+	return waitVMBootUpGetIP(ctx, client, vmref, d, timeout, waitIPv4)
+}
+
+// configIPv4 returns the static ipv4 address cloud-init configures on the first interface.
+func configIPv4(vmConfig map[string]interface{}) (string, bool) {
+	value, _ := vmConfig["ipconfig0"].(string)
+	cidr, ok := parsePropertyList(value, "ip").Get("ip")
+	if !ok || cidr == "dhcp" {
+		return "", false
+	}
+	ip, _, err := net.ParseCIDR(cidr)
+	if err != nil || ip.To4() == nil {
+		return "", false
 	}
-	d.Set("status", vmState["status"])
+	return ip.String(), true
+}
+
+func waitVMBootUpGetIP(ctx context.Context, client *apiClient, vmref *pxapi.VmRef, d *schema.ResourceData, timeout time.Duration, waitIPv4 bool) diag.Diagnostics {
+	tflog.Trace(ctx, "wait vm boot up")
+	deadline, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-	if vmState["status"] == "running" {
-		if agent, ok := vmConfig["agent"]; ok {
-			if agentStr, ok := agent.(string); !ok {
-				tflog.Warn(ctx, "agent parameter returned by pve is not a string, skip fetch ip address")
-			} else if strings.Contains(agentStr, "enabled=1") {
-				if diags := waitVMBootUpGetIP(ctx, client, vmref, d, 1*time.Second); diags != nil {
-					return diags
+	primary := d.Get("primary_interface").(string)
+	// interfaces the agent reported last, to tell a naming mismatch apart from a guest without agent
+	var seen []string
+	for {
+		select {
+		case <-deadline.Done():
+			if seen == nil {
+				return diag.Errorf("timeout when waiting guest agent up and get ip address for that vm")
+			}
+			if primary != "" {
+				return diag.Errorf("timeout when waiting for an ipv4 address of primary_interface %s, the guest agent reports interfaces: %s", primary, strings.Join(seen, ", "))
+			}
+			return diag.Errorf("timeout when waiting for an interface with a global ipv4 address, the guest agent reports interfaces: %s", strings.Join(seen, ", "))
+		default:
+		}
+		tflog.Trace(ctx, "check vm agent network interfaces")
+		ifaces, err := client.GetVmAgentNetworkInterfaces(vmref)
+		if err != nil {
+			if strings.Contains(err.Error(), "guest agent is not running") {
+				time.Sleep(pollDuration)
+				continue
+			}
+			return diag.Errorf("failed to get agent network interfaces: %s", err)
+		}
+		tflog.Trace(ctx, "got vm agent network interfaces")
+		networkInterfaces := make([]interface{}, len(ifaces))
+		for i, iface := range ifaces {
+			ips := make([]string, len(iface.IPAddresses))
+			for j, ip := range iface.IPAddresses {
+				ips[j] = ip.String()
+			}
+			networkInterfaces[i] = map[string]interface{}{
+				"name":         iface.Name,
+				"mac_address":  iface.MACAddress,
+				"mac":          iface.MACAddress,
+				"ip_addresses": ips,
+			}
+		}
+		d.Set("network_interfaces", networkInterfaces)
+		if iface := primaryInterface(ifaces, primary); iface != nil {
+			ipv4 := ""
+			for _, ip := range iface.IPAddresses {
+				if ip4 := ip.To4(); len(ip4) == net.IPv4len {
+					ipv4 = ip.String()
 				}
 			}
+			d.Set("ipv4_address", ipv4)
+			d.Set("ipv6_address", globalIPv6(iface.IPAddresses))
+			if ipv4 != "" || !waitIPv4 {
+				break
+			}
+		} else if !waitIPv4 {
+			break
+		}
+
+		seen = make([]string, 0, len(ifaces))
+		for _, iface := range ifaces {
+			ips := make([]string, len(iface.IPAddresses))
+			for i, ip := range iface.IPAddresses {
+				ips[i] = ip.String()
+			}
+			seen = append(seen, fmt.Sprintf("%s (%s)", iface.Name, strings.Join(ips, " ")))
+		}
+		tflog.Trace(ctx, "wait for ipv4 address", map[string]interface{}{"interfaces": seen})
+		time.Sleep(pollDuration)
+	}
+	return nil
+}
+
+// primaryInterface returns the interface of ifaces named name, or without name the first one
+// with a global ipv4 address. It returns nil when there's no such interface.
+func primaryInterface(ifaces []pxapi.AgentNetworkInterface, name string) *pxapi.AgentNetworkInterface {
+	for i, iface := range ifaces {
+		if name != "" {
+			if iface.Name == name {
+				return &ifaces[i]
+			}
+			continue
+		}
+		for _, ip := range iface.IPAddresses {
+			if ip.To4() != nil && ip.IsGlobalUnicast() {
+				return &ifaces[i]
+			}
+		}
+	}
+	return nil
+}
+
+func osInfoValue(info *agentOSInfo) map[string]interface{} {
+	return map[string]interface{}{
+		"id":             info.ID,
+		"name":           info.Name,
+		"pretty_name":    info.PrettyName,
+		"version":        info.Version,
+		"version_id":     info.VersionID,
+		"kernel_release": info.KernelRelease,
+		"kernel_version": info.KernelVersion,
+		"machine":        info.Machine,
+	}
+}
+
+// globalIPv6 returns the first of ips that is an ipv6 address other than link-local or loopback.
+func globalIPv6(ips []net.IP) string {
+	for _, ip := range ips {
+		if ip.To4() == nil && ip.To16() != nil && !ip.IsLinkLocalUnicast() && !ip.IsLoopback() {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// waitAgentNICs waits until the guest agent reports an interface with the mac address of each
+// of devices.
+func waitAgentNICs(ctx context.Context, client *apiClient, vmref *pxapi.VmRef, vmConfig map[string]interface{}, devices []string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	macs := map[string]bool{}
+	for _, device := range devices {
+		value, _ := vmConfig[device].(string)
+		if mac := nicMAC(value); mac != "" {
+			macs[strings.ToLower(mac)] = true
+		}
+	}
+
+	for {
+		ifaces, err := client.GetVmAgentNetworkInterfaces(vmref)
+		if err != nil && !strings.Contains(err.Error(), "guest agent is not running") {
+			return err
+		}
+		seen := 0
+		for _, iface := range ifaces {
+			if macs[strings.ToLower(iface.MACAddress)] {
+				seen++
+			}
+		}
+		if seen >= len(macs) {
+			return nil
+		}
+
+		tflog.Trace(ctx, "wait agent network interfaces", map[string]interface{}{"devices": devices})
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollDuration):
+		}
+	}
+}
+
+// nicMAC returns the mac address of netN config value.
+func nicMAC(value string) string {
+	l := parsePropertyList(value, "")
+	for _, model := range nicModels {
+		if mac, ok := l.Get(model); ok {
+			return mac
 		}
 	}
+	mac, _ := l.Get("macaddr")
+	return mac
+}
 
-	return nil
+func antiAffinityTag(group string) string {
+	return "anti-affinity." + group
 }
 
-func vmConfigToState(vmConfig map[string]interface{}, d *schema.ResourceData) {
-	d.Set("cores", int(vmConfig["cores"].(float64)))
-	d.Set("memory", int(vmConfig["memory"].(float64)))
-	d.Set("name", vmConfig["name"].(string))
-	if onboot, ok := vmConfig["onboot"]; ok {
-		d.Set("onboot", onboot == float64(1))
-	} else {
-		d.Set("onboot", false)
+// vmTags returns the tags of d along with the management tag and the tag of its anti affinity
+// group, sorted as pve sorts them.
+func vmTags(client *apiClient, d *schema.ResourceData) []string {
+	tags := expandStringList(d.Get("tags").(*schema.Set).List())
+	if client.managementTag != "" {
+		tags = append(tags, client.managementTag)
+	}
+	if group := d.Get("anti_affinity_group").(string); group != "" {
+		tags = append(tags, antiAffinityTag(group))
 	}
+	sort.Strings(tags)
+	return slices.Compact(tags)
 }
 
-func resourceVMUpdate(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
-	client := meta.(*apiClient)
+// splitTags splits the tags config value of a vm, older pve versions separate tags by comma or
+// space instead of semicolon.
+func splitTags(tags string) []string {
+	return strings.FieldsFunc(tags, func(r rune) bool { return r == ';' || r == ',' || r == ' ' })
+}
 
-	vmid, err := strconv.Atoi(d.Id())
-	if err != nil {
-		return diag.Errorf("faild to convert resource id to vmid: %s", err)
+// userTags returns tags without the ones this provider adds itself.
+func userTags(tags []string, managementTag, group string) []interface{} {
+	result := []interface{}{}
+	for _, tag := range tags {
+		if (managementTag != "" && tag == managementTag) || (group != "" && tag == antiAffinityTag(group)) {
+			continue
+		}
+		result = append(result, tag)
 	}
+	return result
+}
 
-	shutdownNeeded := false
+// placeAntiAffinity returns the online node with the fewest vms of anti affinity group, preferring
+// preferred and then the first by name on a tie. The placement of vmid is remembered, so vms of
+// the group created concurrently are spread before they are tagged.
+func placeAntiAffinity(ctx context.Context, client *apiClient, group string, vmid int, preferred string) (string, error) {
+	client.placementMu.Lock()
+	defer client.placementMu.Unlock()
 
-	vmref := pxapi.NewVmRef(vmid)
-	if err := client.CheckVmRef(vmref); err != nil {
-		return diag.Errorf("failed to check vm: %s", err)
+	nodeList, err := client.GetNodeList()
+	if err != nil {
+		return "", err
+	}
+	counts := map[string]int{}
+	nodes, _ := nodeList["data"].([]interface{})
+	for _, node := range nodes {
+		node, _ := node.(map[string]interface{})
+		if name, ok := node["node"].(string); ok && node["status"] == "online" {
+			counts[name] = 0
+		}
 	}
-
-	updates := map[string]interface{}{}
-
-	if d.HasChange("name") {
-		updates["name"] = d.Get("name")
+	if len(counts) == 0 {
+		return "", fmt.Errorf("no node is online")
 	}
 
-	if d.HasChange("cores") {
-		cores := d.Get("cores")
-		updates["cores"] = cores
-		shutdownNeeded = true
-	}
-	if d.HasChange("memory") {
-		memory := d.Get("memory")
-		updates["memory"] = memory
-		shutdownNeeded = true
+	members := map[int]string{}
+	for id, node := range client.placements[group] {
+		members[id] = node
 	}
-	if d.HasChange("onboot") {
-		onboot := d.Get("onboot")
-		updates["onboot"] = onboot
+	vmList, err := client.GetVmList()
+	if err != nil {
+		return "", err
+	}
+	vms, _ := vmList["data"].([]interface{})
+	for _, vm := range vms {
+		vm, _ := vm.(map[string]interface{})
+		tags, _ := vm["tags"].(string)
+		id, _ := vm["vmid"].(float64)
+		node, _ := vm["node"].(string)
+		if slices.Contains(splitTags(tags), antiAffinityTag(group)) {
+			members[int(id)] = node
+		}
 	}
-	if d.HasChange("disk") {
-		oldDisks, newDisks := d.GetChange("disk")
-		if len(oldDisks.([]interface{})) < len(newDisks.([]interface{})) {
-			// add disk
-			for i := len(oldDisks.([]interface{})); i < len(newDisks.([]interface{})); i++ {
-				disk := newDisks.([]interface{})[i]
-				device := fmt.Sprintf("scsi%d", i+1)
-				storage := disk.(map[string]interface{})["storage"].(string)
-				size := disk.(map[string]interface{})["size"].(int)
-				updates[device] = fmt.Sprintf("%s:%d,format=qcow2", storage, size)
-			}
-		} else {
-			// remove disk
-			deletes := []string{}
-			for i := len(newDisks.([]interface{})); i < len(oldDisks.([]interface{})); i++ {
-				device := fmt.Sprintf("scsi%d", i+1)
-				deletes = append(deletes, device)
-			}
-			_, err := client.SetVmConfig(vmref, map[string]interface{}{
-				"delete": strings.Join(deletes, ","),
-			})
-			if err != nil {
-				return diag.Errorf("failed to delete disk: %s", err)
-			}
-			unused := []string{}
-			for i := range deletes {
-				device := fmt.Sprintf("unused%d", i)
-				unused = append(unused, device)
-			}
-			_, err = client.SetVmConfig(vmref, map[string]interface{}{
-				"delete": strings.Join(unused, ","),
-			})
-			if err != nil {
-				return diag.Errorf("failed to delete ununsed disk: %s", err)
-			}
+	for _, node := range members {
+		if _, ok := counts[node]; ok {
+			counts[node]++
 		}
 	}
 
-	if len(updates) > 0 {
-		if err := client.CheckVmRef(vmref); err != nil {
-			return diag.Errorf("failed to check vm: %s", err)
-		}
-		if _, err := client.SetVmConfig(vmref, updates); err != nil {
-			return diag.Errorf("failed to update config: %s", err)
-		}
+	node := leastLoadedNode(counts, preferred)
+	tflog.Debug(ctx, "vm placed by anti affinity", map[string]interface{}{"group": group, "vmid": vmid, "node": node, "counts": counts})
+
+	if client.placements == nil {
+		client.placements = map[string]map[int]string{}
 	}
+	if client.placements[group] == nil {
+		client.placements[group] = map[int]string{}
+	}
+	client.placements[group][vmid] = node
+	return node, nil
+}
 
-	if d.HasChange("template_name") {
-		tplrefs, err := client.GetVmRefsByName(d.Get("template_name").(string))
-		if err != nil {
-			return diag.FromErr(err)
+// leastLoadedNode returns the node of counts with the lowest count, preferring preferred and then
+// the first by name on a tie.
+func leastLoadedNode(counts map[string]int, preferred string) string {
+	nodes := make([]string, 0, len(counts))
+	for node := range counts {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		a, b := nodes[i], nodes[j]
+		if counts[a] != counts[b] {
+			return counts[a] < counts[b]
 		}
-
-		if len(tplrefs) == 0 {
-			return diag.Errorf("template not found")
-		} else if len(tplrefs) > 1 {
-			return diag.Errorf("found multiple template with same template_name")
+		if a == preferred || b == preferred {
+			return a == preferred
 		}
+		return a < b
+	})
+	return nodes[0]
+}
 
-		tplref := tplrefs[0]
-		if tplref.GetVmType() != "qemu" {
-			return diag.Errorf("template is not for qemu vm")
-		}
+// createIncompleteMarker is appended to the description of a clone until its config is written, so
+// a create interrupted in between, eg. by a failed request or a killed terraform, resumes with
+// that vm instead of cloning another one.
+const createIncompleteMarker = "terraform: create incomplete"
+
+func withIncompleteMarker(description string) string {
+	if description == "" {
+		return createIncompleteMarker
+	}
+	return description + "\n\n" + createIncompleteMarker
+}
 
-		if _, err := client.ShutdownVm(vmref); err != nil {
-			return diag.Errorf("failed to shutdown vm: %s", err)
+// findIncompleteVM returns the vm named name whose create was interrupted, along with its
+// description without the marker. It returns a nil vmref without such a vm.
+func findIncompleteVM(client *apiClient, name string) (*pxapi.VmRef, string, error) {
+	vmrefs, err := client.GetVmRefsByName(name)
+	if err != nil {
+		// pxapi reports no vm of name as an error
+		if err.Error() == fmt.Sprintf("vm '%s' not found", name) {
+			return nil, "", nil
 		}
-		if err := waitVMStopped(ctx, client, vmref, waitStoppedTimeout); err != nil {
-			return diag.Errorf("wait vm stopped: %s", err)
+		return nil, "", err
+	}
+	for _, vmref := range vmrefs {
+		vmConfig, err := client.GetVmConfig(vmref)
+		if err != nil {
+			return nil, "", err
 		}
-
-		if err := replaceTemplate(ctx, client, d.Get("name").(string), vmref, tplref); err != nil {
-			return diag.Errorf("failed to replace template: %s", err)
+		description, _ := vmConfig["description"].(string)
+		if base, ok := strings.CutSuffix(strings.TrimRight(description, "\n"), createIncompleteMarker); ok {
+			return vmref, strings.TrimRight(base, "\n"), nil
 		}
-
-		shutdownNeeded = false
 	}
+	return nil, "", nil
+}
 
-	if shutdownNeeded {
-		if _, err := client.ShutdownVm(vmref); err != nil {
-			return diag.Errorf("failed to shutdown vm: %s", err)
+// cloneSize returns the total size of the disks in template config tplConfig, which a full clone
+// allocates anew. Cdroms are left out, they are only referenced.
+func cloneSize(tplConfig map[string]interface{}) (int64, error) {
+	var need int64
+	for device, value := range tplConfig {
+		value, ok := value.(string)
+		if !ok || !diskDeviceRegexp.MatchString(device) {
+			continue
+		}
+		l := parsePropertyList(value, "file")
+		if media, _ := l.Get("media"); media == "cdrom" {
+			continue
 		}
-		if err := waitVMStopped(ctx, client, vmref, waitStoppedTimeout); err != nil {
-			return diag.Errorf("wait vm stopped: %s", err)
+		size, _ := l.Get("size")
+		bytes, err := parseDiskSize(size)
+		if err != nil {
+			return 0, fmt.Errorf("failed to check space for %s of template: %s", device, err)
 		}
+		need += bytes
 	}
+	return need, nil
+}
 
-	vmState, err := client.GetVmState(vmref)
+// checkCloneSpace checks storage on node has room for a full clone of the disks in template
+// config tplConfig.
+func checkCloneSpace(ctx context.Context, client *apiClient, tplConfig map[string]interface{}, node, storage string) error {
+	need, err := cloneSize(tplConfig)
 	if err != nil {
-		return diag.Errorf("failed to get vm state: %s", err)
+		return err
 	}
-	currentStatus := vmState["status"].(string)
-	desiredStatus := d.Get("status").(string)
-
-	switch currentStatus {
-	case "running":
-		switch desiredStatus {
-		case "running":
-		case "stopped":
-			if _, err := client.ShutdownVm(vmref); err != nil {
-				return diag.Errorf("failed to shutdown vm: %s", err)
-			}
-			if err := waitVMStopped(ctx, client, vmref, waitStoppedTimeout); err != nil {
-				return diag.Errorf("wait vm stopped: %s", err)
-			}
-		default:
-			return diag.Errorf("invalid status %q", desiredStatus)
-		}
-	case "stopped":
-		switch desiredStatus {
-		case "running":
-			if _, err := client.StartVm(vmref); err != nil {
-				return diag.Errorf("failed to start vm: %s", err)
-			}
-			vmConfig, err := client.GetVmConfig(vmref)
-			if err != nil {
-				return diag.Errorf("failed to get vm config: %s", err)
-			}
-			if agent, ok := vmConfig["agent"]; ok {
-				if agentStr, ok := agent.(string); !ok {
-					tflog.Warn(ctx, "agent parameter returned by pve is not a string, skip fetch ip address")
-				} else if strings.Contains(agentStr, "enabled=1") {
-					if diags := waitVMBootUpGetIP(ctx, client, vmref, d, waitBootUpTimeout); diags != nil {
-						return diags
-					}
-
-				}
-			}
-		case "stopped":
-		default:
-			return diag.Errorf("invalid status %q", desiredStatus)
-		}
-	default:
-		return diag.Errorf("unknown vm status %q", currentStatus)
+	avail, err := client.storageAvail(node, storage)
+	if err != nil {
+		// eg. no Datastore.Audit on the storage, leave it to the clone
+		tflog.Warn(ctx, "skip space check of storage", map[string]interface{}{"node": node, "storage": storage, "err": err.Error()})
+		return nil
+	}
+	if avail < need {
+		return fmt.Errorf("insufficient space on storage %s of node %s to clone template: need %s, have %s", storage, node, formatDiskSize(need), formatDiskSize(avail))
 	}
-
 	return nil
 }
 
-func resourceVMDelete(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
-	client := meta.(*apiClient)
-
-	vmid, err := strconv.Atoi(d.Id())
+// parseDiskSize parses a pve disk size, eg. "8G" or "512M", into bytes. A size without
+// unit is in bytes.
+func parseDiskSize(size string) (int64, error) {
+	if size == "" {
+		return 0, nil
+	}
+	units := map[byte]int64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+	multiplier := int64(1)
+	if m, ok := units[size[len(size)-1]]; ok {
+		multiplier = m
+		size = size[:len(size)-1]
+	}
+	n, err := strconv.ParseFloat(size, 64)
 	if err != nil {
-		return diag.Errorf("faild to convert resource id to vmid: %s", err)
+		return 0, fmt.Errorf("invalid disk size %q", size)
 	}
+	return int64(n * float64(multiplier)), nil
+}
 
-	vmref := pxapi.NewVmRef(vmid)
+func formatDiskSize(bytes int64) string {
+	return strconv.FormatFloat(float64(bytes)/(1<<30), 'f', 1, 64) + "G"
+}
 
-	vmConfig, err := client.GetVmConfig(vmref)
+// writesSnippets reports whether creating the vm of d writes cloud-init snippets.
+func writesSnippets(d *schema.ResourceDiff) bool {
+	hostname := d.Get("hostname").(string)
+	return d.Get("user_data") != "" || d.Get("timezone") != "" || (hostname != "" && hostname != d.Get("name"))
+}
+
+// expectedCICustom returns the cicustom config create composes for vm vmid of d, referencing the
+// user data snippet for user_data or the user data taken without hostname, and the vendor data
+// snippet for timezone and hostname.
+func expectedCICustom(d *schema.ResourceDiff, vmid int) string {
+	storage := d.Get("snippet_storage").(string)
+	hostname := d.Get("hostname").(string)
+	customHostname := hostname != "" && hostname != d.Get("name")
+	parts := []string{}
+	if d.Get("user_data") != "" || customHostname {
+		parts = append(parts, fmt.Sprintf("user=%s:snippets/vm-%d-cloudinit-user-data", storage, vmid))
+	}
+	if d.Get("timezone") != "" || customHostname {
+		parts = append(parts, fmt.Sprintf("vendor=%s:snippets/vm-%d-cloudinit-vendor-data", storage, vmid))
+	}
+	return strings.Join(parts, ",")
+}
+
+// checkSnippetStorage checks storage allows snippets. It's skipped when the storage can't be read,
+// eg. without Datastore.Audit.
+func checkSnippetStorage(ctx context.Context, client *apiClient, storage string) error {
+	config, err := client.storageConfig(storage)
 	if err != nil {
-		return diag.Errorf("failed to get vm config: %s", err)
+		tflog.Warn(ctx, "skip checking snippet storage", map[string]interface{}{"storage": storage, "err": err.Error()})
+		return nil
 	}
-
-	if cicustom, ok := vmConfig["cicustom"]; ok && strings.TrimSpace(cicustom.(string)) != "" {
-		snippetName := fmt.Sprintf("vm-%d-cloudinit-user-data", vmref.VmId())
-		tflog.Debug(ctx, "delete snippets to local:"+snippetName)
-		command := "rm -f /var/lib/vz/snippets/" + snippetName
-		if err := executeCommandOnNode(client.session, vmref.Node(), command); err != nil {
-			tflog.Warn(ctx, "failed to delete snippets local:"+snippetName, map[string]interface{}{"err": err.Error()})
-		}
+	if !slices.Contains(config.Content, "snippets") {
+		return fmt.Errorf("snippet_storage %s doesn't allow snippets, allowed content: %s", storage, strings.Join(config.Content, ", "))
 	}
+	return nil
+}
 
-	tflog.Debug(ctx, "shutdown vm", map[string]interface{}{"vmid": vmid})
-
-	_, err = client.ShutdownVm(vmref)
+// writeSnippet writes content to snippet snippetName on storage for the node of vm. It's uploaded
+// through the storage api, or through the node shell where pve doesn't take snippets uploads.
+// attr names the attribute the snippet is written for in errors.
+func writeSnippet(ctx context.Context, client *apiClient, vmref *pxapi.VmRef, storage, snippetName, content, attr string) diag.Diagnostics {
+	node, err := client.resolveNode(vmref.VmId())
 	if err != nil {
-		return diag.Errorf("failed to stop vm %d: %s", vmid, err)
+		return diag.Errorf("failed to configure %s: failed to resolve node: %s", attr, err)
 	}
 
-	if err := waitVMStopped(ctx, client, vmref, waitStoppedTimeout); err != nil {
-		return diag.Errorf("wait vm stopped: %s", err)
+	tflog.Debug(ctx, "upload snippets to "+storage+":snippets/"+snippetName)
+	err = client.Upload(node, storage, "snippets", snippetName, strings.NewReader(content))
+	if err == nil {
+		return nil
 	}
-	tflog.Debug(ctx, "vm stopped")
+	// pve rejects the content type with a 400 before snippets uploads were supported
+	if !strings.HasPrefix(err.Error(), "400 ") {
+		return diag.Errorf("failed to configure %s: failed to upload snippet to storage %s: %s", attr, storage, err)
+	}
+	tflog.Debug(ctx, "storage api doesn't take snippets, write through the node shell", map[string]interface{}{"err": err.Error()})
 
-	_, err = client.DeleteVm(vmref)
+	dir, err := snippetsDir(client, storage)
 	if err != nil {
-		return diag.FromErr(err)
+		return diag.Errorf("failed to configure %s: %s", attr, err)
 	}
-	tflog.Debug(ctx, "vm deleted")
 
+	encoded := base64.StdEncoding.EncodeToString([]byte(content))
+
+	command := fmt.Sprintf("test -w %s || exit %d; echo %q | base64 -d > %s/%s", dir, exitStatusNotWritable, encoded, dir, snippetName)
+
+	if err := executeCommandOnClientNode(ctx, client, node, command); err != nil {
+		var exitErr *commandExitError
+		if errors.As(err, &exitErr) && exitErr.ExitStatus == exitStatusNotWritable {
+			return diag.Errorf("failed to configure %s: shell user %s can't write to %s on node %s, %s needs an account with node shell access and write permission on the snippets directory", attr, exitErr.User, dir, exitErr.Node, attr)
+		}
+		return diag.Errorf("failed to configure %s: %s", attr, err)
+	}
 	return nil
 }
 
-func waitVMStopped(ctx context.Context, client *apiClient, vmref *pxapi.VmRef, timeout time.Duration) error {
-	ctx, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
+// deleteSnippet deletes snippet snippetName from storage through the storage api, falling back to
+// the node shell like writeSnippet.
+func deleteSnippet(ctx context.Context, client *apiClient, vmref *pxapi.VmRef, storage, snippetName string) error {
+	tflog.Debug(ctx, "delete snippets "+storage+":snippets/"+snippetName)
+	volid := url.PathEscape(storage + ":snippets/" + snippetName)
+	_, err := client.DeleteVolume(vmref, storage, volid)
+	if err == nil {
+		return nil
+	}
+	tflog.Debug(ctx, "failed to delete snippet through the storage api, delete through the node shell", map[string]interface{}{"err": err.Error()})
 
-	for {
+	dir, err := snippetsDir(client, storage)
+	if err != nil {
+		return err
+	}
+	return executeCommandOnVMNode(ctx, client, vmref.VmId(), "rm -f "+dir+"/"+snippetName)
+}
 
-		state, err := client.GetVmState(vmref)
-		if err != nil {
-			return err
-		}
-		if state["status"] == "stopped" {
-			break
+// snippetsDir returns the directory snippets of storage are kept in on the nodes.
+func snippetsDir(client *apiClient, storage string) (string, error) {
+	config, err := client.storageConfig(storage)
+	if err != nil {
+		// the well known path, for accounts without Datastore.Audit
+		if storage == "local" {
+			return "/var/lib/vz/snippets", nil
 		}
+		return "", fmt.Errorf("failed to get config of storage %s: %s", storage, err)
+	}
+	if config.Path == "" {
+		return "", fmt.Errorf("storage %s of type %s has no directory for snippets", storage, config.Type)
+	}
+	return config.Path + "/snippets", nil
+}
 
-		tflog.Trace(ctx, "vm state", state)
+// validateTimezone checks v is a name of the tz database, eg. "Europe/Berlin" or "UTC".
+func validateTimezone(v interface{}, k string) (ws []string, errs []error) {
+	name := v.(string)
+	if name == "" || name == "Local" {
+		return nil, []error{fmt.Errorf("%s must be a tz database name, got %q", k, name)}
+	}
+	if _, err := time.LoadLocation(name); err != nil {
+		return nil, []error{fmt.Errorf("%s is not a known tz database name: %q", k, name)}
+	}
+	return nil, nil
+}
 
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-time.After(pollDuration):
+// cloudConfigKeys are the top level keys of cloud-config known to cloud-init modules.
+var cloudConfigKeys = []string{
+	"allow_public_ssh_keys", "ansible", "apk_repos", "apt", "apt_pipelining",
+	"apt_reboot_if_required", "apt_update", "apt_upgrade", "autoinstall", "bootcmd",
+	"byobu_by_default", "ca_certs", "ca-certs", "chef", "chpasswd", "cloud_config_modules",
+	"cloud_final_modules", "cloud_init_modules", "create_hostname_file", "datasource",
+	"datasource_list", "device_aliases", "disable_ec2_metadata", "disable_root", "disable_root_opts",
+	"disk_setup", "drivers", "fan", "final_message", "fqdn", "fs_setup", "groups", "growpart",
+	"grub_dpkg", "grub-dpkg", "hostname", "keyboard", "landscape", "locale", "locale_configfile",
+	"lxd", "manage_etc_hosts", "manage_resolv_conf", "mcollective", "merge_how", "merge_type",
+	"mount_default_fields", "mounts", "network", "no_ssh_fingerprints", "ntp", "output",
+	"package_reboot_if_required", "package_update", "package_upgrade", "packages", "password",
+	"phone_home", "power_state", "prefer_fqdn_over_hostname", "preserve_hostname", "puppet",
+	"random_seed", "reporting", "resize_rootfs", "resolv_conf", "rh_subscription", "rsyslog",
+	"runcmd", "salt_minion", "snap", "spacewalk", "ssh", "ssh_authorized_keys", "ssh_deletekeys",
+	"ssh_fp_console_blacklist", "ssh_genkeytypes", "ssh_import_id", "ssh_key_console_blacklist",
+	"ssh_keys", "ssh_publish_hostkeys", "ssh_pwauth", "ssh_quiet_keygen", "ssh_redirect_user", "swap",
+	"syslog_fix_perms", "system_info", "timezone", "ubuntu_advantage", "ubuntu_pro", "updates",
+	"user", "users", "vendor_data", "wireguard", "write_files", "yum_repo_dir", "yum_repos", "zypper",
+}
+
+// validateUserData checks user data starting with #cloud-config is a yaml mapping, and warns
+// about top level keys cloud-init doesn't know, eg. from a typo or a nested key indented wrong.
+// Other user data formats, like scripts or jinja templates, aren't checked.
+func validateUserData(v interface{}, k string) (ws []string, errs []error) {
+	userData := v.(string)
+	if !strings.HasPrefix(userData, "#cloud-config") {
+		return nil, nil
+	}
+	var config map[string]interface{}
+	if err := yaml.Unmarshal([]byte(userData), &config); err != nil {
+		return nil, []error{fmt.Errorf("%s is not valid cloud-config yaml: %s", k, err)}
+	}
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !slices.Contains(cloudConfigKeys, key) {
+			ws = append(ws, fmt.Sprintf("%s has cloud-config key %q unknown to cloud-init, it's ignored by the guest", k, key))
 		}
 	}
+	return ws, nil
+}
 
-	return nil
+// exitStatusNotWritable is used by snippet commands to tell a missing write permission apart from other failures
+const exitStatusNotWritable = 77
+
+// commandExitError is returned by executeCommandOnNode when the command exits with non-zero status
+type commandExitError struct {
+	Node       string
+	User       string
+	ExitStatus int
 }
 
-func waitVMBootUpGetIP(ctx context.Context, client *apiClient, vmref *pxapi.VmRef, d *schema.ResourceData, timeout time.Duration) diag.Diagnostics {
-	tflog.Trace(ctx, "wait vm boot up")
-	deadline, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+func (e *commandExitError) Error() string {
+	return fmt.Sprintf("command failed with exit status %d (node %s, shell user %s)", e.ExitStatus, e.Node, e.User)
+}
 
-	for {
-		select {
-		case <-deadline.Done():
-			return diag.Errorf("timeout when waiting guest agent up and get ip address for that vm")
-		default:
-		}
-		tflog.Trace(ctx, "check vm agent network interfaces")
-		ifaces, err := client.GetVmAgentNetworkInterfaces(vmref)
-		if err != nil {
-			if strings.Contains(err.Error(), "guest agent is not running") {
-				time.Sleep(pollDuration)
-				continue
-			}
-			return diag.Errorf("failed to get agent network interfaces: %s", err)
-		}
-		tflog.Trace(ctx, "got vm agent network interfaces")
-		for _, iface := range ifaces {
-			if iface.Name == "eth0" {
-				for _, ip := range iface.IPAddresses {
-					if ip4 := ip.To4(); len(ip4) == net.IPv4len {
-						d.Set("ipv4_address", ip.String())
-					}
-				}
-			}
+// shellQuote quotes s as a single word for the node shell, nothing inside is expanded.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// executeCommandOnVMNode executes command on the node where vm vmid currently sits.
+func executeCommandOnVMNode(ctx context.Context, client *apiClient, vmid int, command string) error {
+	node, err := client.resolveNode(vmid)
+	if err != nil {
+		return fmt.Errorf("failed to resolve node: %s", err)
+	}
+	return executeCommandOnClientNode(ctx, client, node, command)
+}
+
+// executeCommandOnClientNode executes command on node with the session of client, logging
+// its output when debug_commands is enabled.
+func executeCommandOnClientNode(ctx context.Context, client *apiClient, node, command string) error {
+	session, err := client.getSession()
+	if err != nil {
+		return err
+	}
+	output, err := executeCommandOnNode(session, node, command)
+	if client.debugCommands {
+		fields := map[string]interface{}{"node": node, "output": output, "exit_status": 0}
+		var exitErr *commandExitError
+		if errors.As(err, &exitErr) {
+			fields["exit_status"] = exitErr.ExitStatus
+		} else if err != nil {
+			fields["err"] = err.Error()
 		}
-		break
+		tflog.Debug(ctx, "node command finished", fields)
 	}
-	return nil
+	return err
 }
 
-func executeCommandOnNode(session *pxapi.Session, node, command string) error {
+// executeCommandOnNode executes command in the shell of node and returns its output, which is
+// also returned along with a *commandExitError.
+func executeCommandOnNode(session *pxapi.Session, node, command string) (string, error) {
 	var respData struct {
 		Data struct {
 			Port   string `json:"port"`
@@ -592,12 +3789,12 @@ func executeCommandOnNode(session *pxapi.Session, node, command string) error {
 
 	_, err := session.PostJSON(fmt.Sprintf("/nodes/%s/termproxy", node), nil, nil, nil, &respData)
 	if err != nil {
-		return fmt.Errorf("failed to acquire termproxy ticket: %s", err)
+		return "", fmt.Errorf("failed to acquire termproxy ticket, the account needs Sys.Console on /nodes/%s: %s", node, err)
 	}
 
 	u, err := url.Parse(session.ApiUrl)
 	if err != nil {
-		return fmt.Errorf("failed to parse api url: %s", err)
+		return "", fmt.Errorf("failed to parse api url: %s", err)
 	}
 	origin := (&url.URL{
 		Scheme: u.Scheme,
@@ -617,7 +3814,7 @@ func executeCommandOnNode(session *pxapi.Session, node, command string) error {
 
 	wsConf, err := websocket.NewConfig(wsUrl, origin)
 	if err != nil {
-		return fmt.Errorf("failed to construct websocket config: %s", err)
+		return "", fmt.Errorf("failed to construct websocket config: %s", err)
 	}
 	wsConf.Protocol = []string{"binary"}
 	if session.AuthToken != "" {
@@ -629,27 +3826,27 @@ func executeCommandOnNode(session *pxapi.Session, node, command string) error {
 
 	c, err := websocket.DialConfig(wsConf)
 	if err != nil {
-		return fmt.Errorf("failed to create websocket connection: %s", err)
+		return "", fmt.Errorf("failed to create websocket connection: %s", err)
 	}
 	defer c.Close()
 
 	_, err = c.Write([]byte(respData.Data.User + ":" + respData.Data.Ticket + "\n"))
 	if err != nil {
-		return fmt.Errorf("failed to send ticket: %s", err)
+		return "", fmt.Errorf("failed to send ticket: %s", err)
 	}
 
 	b := make([]byte, 10)
 	n, err := c.Read(b)
 	if err != nil {
-		return fmt.Errorf("failed to read response: %s", err)
+		return "", fmt.Errorf("failed to read response: %s", err)
 	}
 	if string(b[:n]) != "OK" {
-		return fmt.Errorf("incorrect ticket: %s", err)
+		return "", fmt.Errorf("incorrect ticket: %s", err)
 	}
 
 	_, err = c.Write([]byte(`1:80:24:`))
 	if err != nil {
-		return fmt.Errorf("failed to send message: %s", err)
+		return "", fmt.Errorf("failed to send message: %s", err)
 	}
 
 	insertBegin := []byte{0x1b, '[', '2', '0', '0', '~'}
@@ -661,15 +3858,15 @@ func executeCommandOnNode(session *pxapi.Session, node, command string) error {
 
 	_, err = c.Write([]byte(cmd))
 	if err != nil {
-		return fmt.Errorf("failed to send message: %s", err)
+		return "", fmt.Errorf("failed to send message: %s", err)
 	}
 	_, err = c.Write([]byte("0:1:\n"))
 	if err != nil {
-		return fmt.Errorf("failed to send message: %s", err)
+		return "", fmt.Errorf("failed to send message: %s", err)
 	}
 
 	lr := bufio.NewReader(c)
-	// output := bytes.NewBuffer(nil)
+	output := bytes.NewBuffer(nil)
 	footer := bytes.NewBuffer(nil)
 	state := "none"
 
@@ -678,7 +3875,7 @@ loop:
 		c.SetReadDeadline(time.Now().Add(30 * time.Second))
 		line, err := lr.ReadString('\n')
 		if err != nil {
-			return fmt.Errorf("failed to read message")
+			return "", fmt.Errorf("failed to read message")
 		}
 		switch state {
 		case "none":
@@ -690,8 +3887,8 @@ loop:
 			switch line {
 			case "CMD-FINISH-" + boundry + "\r\n":
 				state = "finish"
-				// default:
-				// 	output.WriteString(line)
+			default:
+				output.WriteString(line)
 			}
 		case "finish":
 			switch line {
@@ -707,17 +3904,56 @@ loop:
 	var exitStatus int
 	_, err = fmt.Sscanf(footer.String(), "exit_status=%d", &exitStatus)
 	if err != nil {
-		return fmt.Errorf("exit_status not found in footer")
+		return "", fmt.Errorf("exit_status not found in footer")
 	}
 
+	// the terminal ends lines with \r\n
+	out := strings.ReplaceAll(output.String(), "\r\n", "\n")
 	if exitStatus != 0 {
-		return fmt.Errorf("command failed with exit status %d", exitStatus)
+		return out, &commandExitError{Node: node, User: respData.Data.User, ExitStatus: exitStatus}
+	}
+
+	return out, nil
+}
+
+// createNetbootVM creates a bare vm booting from its first nic, it has neither disk nor cloud-init drive,
+// disk blocks are attached afterwards like for a cloned vm.
+func createNetbootVM(ctx context.Context, client *apiClient, d *schema.ResourceData, vmid int) error {
+	nic := d.Get("network").([]interface{})[0].(map[string]interface{})
+	params := map[string]interface{}{
+		"vmid":   vmid,
+		"name":   d.Get("name").(string),
+		"cores":  d.Get("cores").(int),
+		"memory": d.Get("memory").(int),
+		"net0":   nicWithOptions("", nic),
+		"boot":   "order=net0",
+	}
+	if pool, ok := d.GetOk("pool"); ok {
+		params["pool"] = pool
 	}
 
+	tflog.Debug(ctx, "create netboot vm", map[string]interface{}{"vmid": vmid})
+
+	if _, err := client.CreateQemuVm(d.Get("target_node").(string), params); err != nil {
+		return err
+	}
 	return nil
 }
 
-func replaceTemplate(ctx context.Context, client *apiClient, vmName string, vmref, tplref *pxapi.VmRef) error {
+func sourceTemplateValue(name string, tplref *pxapi.VmRef) []interface{} {
+	return []interface{}{map[string]interface{}{"name": name, "vmid": tplref.VmId()}}
+}
+
+// cloneError describes err from cloning template tplref, pointing at full_clone when a linked
+// clone was refused.
+func cloneError(tplref *pxapi.VmRef, fullClone bool, err error) error {
+	if !fullClone && strings.Contains(strings.ToLower(err.Error()), "linked clone") {
+		return fmt.Errorf("failed to create linked clone of template %d, its storage doesn't support linked clones, set full_clone to true: %s", tplref.VmId(), err)
+	}
+	return fmt.Errorf("failed to clone vm %d: %s", tplref.VmId(), err)
+}
+
+func replaceTemplate(ctx context.Context, client *apiClient, vmName string, vmref, tplref *pxapi.VmRef, fullClone bool, storage string, keep []string, timeout time.Duration) error {
 	tplConfig, err := client.GetVmConfig(tplref)
 	if err != nil {
 		return fmt.Errorf("failed to get template config: %s", err)
@@ -741,14 +3977,22 @@ func replaceTemplate(ctx context.Context, client *apiClient, vmName string, vmre
 
 	cloneParams := map[string]interface{}{
 		"newid":  newid,
-		"full":   true,
+		"full":   fullClone,
 		"name":   vmName + "-upgrade",
 		"target": tplref.Node(),
 	}
+	if fullClone {
+		cloneParams["storage"] = storage
+	}
 
-	_, err = client.CloneQemuVm(tplref, cloneParams)
+	release, err := client.acquireClone(ctx, tplref.Node())
+	if err != nil {
+		return err
+	}
+	err = client.cloneQemuVm(ctx, tplref, cloneParams, timeout)
+	release()
 	if err != nil {
-		return fmt.Errorf("failed to clone vm %d: %s", tplref.VmId(), err)
+		return cloneError(tplref, fullClone, err)
 	}
 	newvmref := pxapi.NewVmRef(newid)
 	defer func() {
@@ -783,10 +4027,21 @@ func replaceTemplate(ctx context.Context, client *apiClient, vmName string, vmre
 		return fmt.Errorf("failed to remove unused disk: %s", err)
 	}
 
-	// update some config from template
+	// keep cpu flags of the vm, only the cpu type comes from template
+	if vmCPU, ok := vmConfig["cpu"].(string); ok {
+		if flags, ok := parsePropertyList(vmCPU, "cputype").Get("flags"); ok {
+			tplCPU, _ := tplConfig["cpu"].(string)
+			tplConfig["cpu"] = cpuWithFlags(tplCPU, strings.Split(flags, ";"))
+		}
+	}
+
+	// update some config from template, network devices are left untouched so mac addresses survive the switch
 	updates := map[string]interface{}{}
 	deletes := []string{}
 	for _, n := range []string{"ostype", "vga", "cpu"} {
+		if slices.Contains(keep, n) {
+			continue
+		}
 		if tplConfig[n] != vmConfig[n] {
 			if tplConfig[n] == nil {
 				deletes = append(deletes, n)
@@ -810,3 +4065,19 @@ func replaceTemplate(ctx context.Context, client *apiClient, vmName string, vmre
 
 	return nil
 }
+
+// importOVF creates vm newid on node from an OVF manifest, it works like `qm importovf`.
+func importOVF(ctx context.Context, client *apiClient, node string, newid int, manifest, storage string) error {
+	if err := executeCommandOnClientNode(ctx, client, node, "test -r "+shellQuote(manifest)); err != nil {
+		return fmt.Errorf("ovf manifest %s is not readable on node %s: %s", manifest, node, err)
+	}
+
+	tflog.Debug(ctx, "import ovf", map[string]interface{}{"vmid": newid, "manifest": manifest})
+
+	command := fmt.Sprintf("qm importovf %d %s %s", newid, shellQuote(manifest), shellQuote(storage))
+	if err := executeCommandOnClientNode(ctx, client, node, command); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,325 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	pxapi "github.com/Telmate/proxmox-api-go/proxmox"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+)
+
+func resourceVMStartup() *schema.Resource {
+	return &schema.Resource{
+		Description: "Boot order of a set of VMs, derived from declared dependencies. Each VM gets the `order` of its `startup` setting assigned so it's started after the VMs it depends on when the node boots. Other startup options like `up` and `down` are left as they are.",
+
+		CreateContext: resourceVMStartupCreate,
+		ReadContext:   resourceVMStartupRead,
+		UpdateContext: resourceVMStartupUpdate,
+		DeleteContext: resourceVMStartupDelete,
+
+		CustomizeDiff: resourceVMStartupCustomizeDiff,
+
+		Schema: map[string]*schema.Schema{
+			"dependency": {
+				Description: "VM `before` is started ahead of VM `after`.",
+				Type:        schema.TypeList,
+				Required:    true,
+				MinItems:    1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"before": {
+							Description:  "ID of the VM started first.",
+							Type:         schema.TypeInt,
+							Required:     true,
+							ValidateFunc: validation.IntAtLeast(100),
+						},
+						"after": {
+							Description:  "ID of the VM started later.",
+							Type:         schema.TypeInt,
+							Required:     true,
+							ValidateFunc: validation.IntAtLeast(100),
+						},
+					},
+				},
+			},
+			"first_order": {
+				Description:  "Order assigned to the VMs started first, the following ones get sequential orders.",
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      1,
+				ValidateFunc: validation.IntAtLeast(0),
+			},
+			"orders": {
+				Description: "Startup order assigned to each VM, keyed by VM ID.",
+				Type:        schema.TypeMap,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeInt},
+			},
+		},
+	}
+}
+
+type startupDependency struct {
+	before, after int
+}
+
+func startupDependencies(deps []interface{}) []startupDependency {
+	result := make([]startupDependency, 0, len(deps))
+	for _, dep := range deps {
+		dep := dep.(map[string]interface{})
+		result = append(result, startupDependency{before: dep["before"].(int), after: dep["after"].(int)})
+	}
+	return result
+}
+
+// startupOrders assigns sequential orders from first to the VMs of deps, so every VM comes after
+// the VMs it depends on. VMs without dependencies between each other are ordered by ID.
+func startupOrders(deps []startupDependency, first int) (map[int]int, error) {
+	incoming := map[int]int{}
+	next := map[int][]int{}
+	for _, dep := range deps {
+		if dep.before == dep.after {
+			return nil, fmt.Errorf("vm %d can't be started before itself", dep.before)
+		}
+		if _, ok := incoming[dep.before]; !ok {
+			incoming[dep.before] = 0
+		}
+		incoming[dep.after]++
+		next[dep.before] = append(next[dep.before], dep.after)
+	}
+
+	ready := []int{}
+	for vmid, n := range incoming {
+		if n == 0 {
+			ready = append(ready, vmid)
+		}
+	}
+	orders := map[int]int{}
+	for len(ready) > 0 {
+		sort.Ints(ready)
+		vmid := ready[0]
+		ready = ready[1:]
+		orders[vmid] = first + len(orders)
+		for _, after := range next[vmid] {
+			incoming[after]--
+			if incoming[after] == 0 {
+				ready = append(ready, after)
+			}
+		}
+	}
+
+	if len(orders) < len(incoming) {
+		cycle := []string{}
+		for vmid := range incoming {
+			if _, ok := orders[vmid]; !ok {
+				cycle = append(cycle, strconv.Itoa(vmid))
+			}
+		}
+		sort.Strings(cycle)
+		return nil, fmt.Errorf("dependencies between vms %s form a cycle", strings.Join(cycle, ", "))
+	}
+	return orders, nil
+}
+
+func resourceVMStartupCustomizeDiff(ctx context.Context, d *schema.ResourceDiff, meta interface{}) error {
+	if !d.NewValueKnown("dependency") || !d.NewValueKnown("first_order") {
+		d.SetNewComputed("orders")
+		return nil
+	}
+	orders, err := startupOrders(startupDependencies(d.Get("dependency").([]interface{})), d.Get("first_order").(int))
+	if err != nil {
+		return err
+	}
+	// also plans an update when orders were changed outside of terraform
+	if !startupOrdersEqual(d.Get("orders").(map[string]interface{}), orders) {
+		return d.SetNew("orders", startupOrdersValue(orders))
+	}
+	return nil
+}
+
+func resourceVMStartupCreate(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*apiClient)
+
+	orders, err := startupOrders(startupDependencies(d.Get("dependency").([]interface{})), d.Get("first_order").(int))
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	if err := setStartupOrders(ctx, client, orders); err != nil {
+		return diag.FromErr(err)
+	}
+	d.Set("orders", startupOrdersValue(orders))
+
+	vmids := make([]string, 0, len(orders))
+	for vmid := range orders {
+		vmids = append(vmids, strconv.Itoa(vmid))
+	}
+	sort.Strings(vmids)
+	d.SetId(strings.Join(vmids, ","))
+
+	return resourceVMStartupRead(ctx, d, meta)
+}
+
+func resourceVMStartupRead(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*apiClient)
+
+	orders := map[string]interface{}{}
+	for key := range d.Get("orders").(map[string]interface{}) {
+		vmid, err := strconv.Atoi(key)
+		if err != nil {
+			return diag.Errorf("invalid vmid %q in orders: %s", key, err)
+		}
+		vmref := pxapi.NewVmRef(vmid)
+		if err := client.CheckVmRef(vmref); err != nil {
+			if isVMNotFound(err, vmid) {
+				tflog.Warn(ctx, "vm of startup order no longer exists", map[string]interface{}{"vmid": vmid})
+				continue
+			}
+			return diag.FromErr(err)
+		}
+		vmConfig, err := client.GetVmConfig(vmref)
+		if err != nil {
+			return diag.Errorf("failed to get vm config: %s", err)
+		}
+		startup, _ := vmConfig["startup"].(string)
+		if order, ok := parsePropertyList(startup, "order").Get("order"); ok {
+			if n, err := strconv.Atoi(order); err == nil {
+				orders[key] = n
+			}
+		}
+	}
+	if len(orders) == 0 {
+		tflog.Warn(ctx, "none of the vms has a startup order left", map[string]interface{}{"id": d.Id()})
+		d.SetId("")
+		return nil
+	}
+	d.Set("orders", orders)
+
+	return nil
+}
+
+func resourceVMStartupUpdate(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*apiClient)
+
+	orders, err := startupOrders(startupDependencies(d.Get("dependency").([]interface{})), d.Get("first_order").(int))
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	// vms no longer part of the dependencies lose their order
+	oldOrders, _ := d.GetChange("orders")
+	for key := range oldOrders.(map[string]interface{}) {
+		vmid, _ := strconv.Atoi(key)
+		if _, ok := orders[vmid]; !ok {
+			if err := clearStartupOrder(ctx, client, vmid); err != nil {
+				return diag.FromErr(err)
+			}
+		}
+	}
+
+	if err := setStartupOrders(ctx, client, orders); err != nil {
+		return diag.FromErr(err)
+	}
+	d.Set("orders", startupOrdersValue(orders))
+
+	return resourceVMStartupRead(ctx, d, meta)
+}
+
+func resourceVMStartupDelete(ctx context.Context, d *schema.ResourceData, meta interface{}) diag.Diagnostics {
+	client := meta.(*apiClient)
+
+	for key := range d.Get("orders").(map[string]interface{}) {
+		vmid, err := strconv.Atoi(key)
+		if err != nil {
+			return diag.Errorf("invalid vmid %q in orders: %s", key, err)
+		}
+		if err := clearStartupOrder(ctx, client, vmid); err != nil {
+			return diag.FromErr(err)
+		}
+	}
+
+	return nil
+}
+
+func setStartupOrders(ctx context.Context, client *apiClient, orders map[int]int) error {
+	vmids := make([]int, 0, len(orders))
+	for vmid := range orders {
+		vmids = append(vmids, vmid)
+	}
+	sort.Ints(vmids)
+	for _, vmid := range vmids {
+		order := strconv.Itoa(orders[vmid])
+		err := updateStartup(client, vmid, func(l *propertyList) { l.Set("order", order) })
+		if err != nil {
+			return fmt.Errorf("failed to set startup order of vm %d: %s", vmid, err)
+		}
+		tflog.Debug(ctx, "startup order set", map[string]interface{}{"vmid": vmid, "order": order})
+	}
+	return nil
+}
+
+// clearStartupOrder removes the order from the startup setting of vm, a vm that no longer
+// exists is skipped.
+func clearStartupOrder(ctx context.Context, client *apiClient, vmid int) error {
+	err := updateStartup(client, vmid, func(l *propertyList) { l.Delete("order") })
+	if err != nil {
+		if isVMNotFound(err, vmid) {
+			return nil
+		}
+		return fmt.Errorf("failed to remove startup order of vm %d: %s", vmid, err)
+	}
+	tflog.Debug(ctx, "startup order removed", map[string]interface{}{"vmid": vmid})
+	return nil
+}
+
+// updateStartup applies update to the startup setting of vm, keeping its other options.
+func updateStartup(client *apiClient, vmid int, update func(*propertyList)) error {
+	vmref := pxapi.NewVmRef(vmid)
+	if err := client.CheckVmRef(vmref); err != nil {
+		return err
+	}
+	vmConfig, err := client.GetVmConfig(vmref)
+	if err != nil {
+		return err
+	}
+	startup, _ := vmConfig["startup"].(string)
+	l := parsePropertyList(startup, "order")
+	update(l)
+
+	params := map[string]interface{}{}
+	if value := l.String(); value != "" {
+		params["startup"] = value
+	} else if startup != "" {
+		params["delete"] = "startup"
+	} else {
+		return nil
+	}
+	_, err = client.SetVmConfig(vmref, params)
+	return err
+}
+
+func startupOrdersEqual(state map[string]interface{}, orders map[int]int) bool {
+	if len(state) != len(orders) {
+		return false
+	}
+	for vmid, order := range orders {
+		if v, ok := state[strconv.Itoa(vmid)].(int); !ok || v != order {
+			return false
+		}
+	}
+	return true
+}
+
+func startupOrdersValue(orders map[int]int) map[string]interface{} {
+	value := make(map[string]interface{}, len(orders))
+	for vmid, order := range orders {
+		value[strconv.Itoa(vmid)] = order
+	}
+	return value
+}
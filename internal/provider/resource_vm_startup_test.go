@@ -0,0 +1,94 @@
+package provider
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
+)
+
+func TestStartupOrders(t *testing.T) {
+	cases := []struct {
+		deps  []startupDependency
+		first int
+		want  map[int]int
+	}{
+		{
+			deps:  []startupDependency{{before: 100, after: 101}},
+			first: 1,
+			want:  map[int]int{100: 1, 101: 2},
+		},
+		{
+			deps:  []startupDependency{{before: 102, after: 100}, {before: 102, after: 101}, {before: 101, after: 100}},
+			first: 10,
+			want:  map[int]int{102: 10, 101: 11, 100: 12},
+		},
+		{
+			deps:  []startupDependency{{before: 103, after: 104}, {before: 100, after: 101}},
+			first: 1,
+			want:  map[int]int{100: 1, 101: 2, 103: 3, 104: 4},
+		},
+	}
+
+	for _, c := range cases {
+		got, err := startupOrders(c.deps, c.first)
+		if err != nil {
+			t.Errorf("startupOrders(%v) failed: %s", c.deps, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("startupOrders(%v) = %v; want %v", c.deps, got, c.want)
+		}
+	}
+
+	for _, deps := range [][]startupDependency{
+		{{before: 100, after: 100}},
+		{{before: 100, after: 101}, {before: 101, after: 102}, {before: 102, after: 100}},
+	} {
+		if _, err := startupOrders(deps, 1); err == nil {
+			t.Errorf("startupOrders(%v) passed; want an error", deps)
+		}
+	}
+}
+
+func TestAccResourceVMStartup(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-startup"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+				}
+
+				resource "pve_vm" "vm2" {
+					name = "test-vm2-startup"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+				}
+
+				resource "pve_vm_startup" "boot" {
+					dependency {
+						before = pve_vm.vm2.id
+						after = pve_vm.vm1.id
+					}
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm_startup.boot", "orders.%", "2"),
+					testAccCheckVMConfigKeys("pve_vm.vm1", "startup"),
+					testAccCheckVMConfigKeys("pve_vm.vm2", "startup"),
+				),
+			},
+		},
+	})
+}
@@ -1,12 +1,22 @@
 package provider
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
 
 	pxapi "github.com/Telmate/proxmox-api-go/proxmox"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
 )
 
 func TestAccResourceVMCPUMemory(t *testing.T) {
@@ -27,6 +37,8 @@ func TestAccResourceVMCPUMemory(t *testing.T) {
 				`,
 				Check: resource.ComposeTestCheckFunc(
 					resource.TestCheckResourceAttrSet("pve_vm.vm1", "ipv4_address"),
+					// network_interfaces.0 is the loopback interface
+					resource.TestCheckResourceAttrSet("pve_vm.vm1", "network_interfaces.1.mac_address"),
 					resource.TestCheckResourceAttr("pve_vm.vm1", "cores", "1"),
 					resource.TestCheckResourceAttr("pve_vm.vm1", "memory", "512"),
 				),
@@ -53,6 +65,374 @@ func TestAccResourceVMCPUMemory(t *testing.T) {
 	})
 }
 
+func TestAccResourceVMCPUFlags(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-cpu-flags"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+					cpu_flags = ["+aes"]
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "cpu_flags.#", "1"),
+					resource.TestCheckResourceAttr("pve_vm.vm1", "cpu_flags.0", "+aes"),
+				),
+			},
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-cpu-flags"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+					cpu_flags = ["+aes", "-spec-ctrl"]
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "cpu_flags.#", "2"),
+					resource.TestCheckResourceAttr("pve_vm.vm1", "cpu_flags.1", "-spec-ctrl"),
+				),
+			},
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-cpu-flags"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+				}
+				`,
+				PlanOnly: true,
+			},
+		},
+	})
+}
+
+func TestAccResourceVMCPUType(t *testing.T) {
+	config := func(cpuType string) string {
+		return fmt.Sprintf(`
+		resource "pve_vm" "vm1" {
+			name = "test-vm1-cpu-type"
+			template_name = "debian-10.11.4-20220312"
+			target_node = "pve"
+			target_storage = "local"
+			cores = 1
+			memory = 512
+			cpu_type = %q
+			cpu_flags = ["+aes"]
+		}
+		`, cpuType)
+	}
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config("x86-64-v2-AES"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "cpu_type", "x86-64-v2-AES"),
+					resource.TestCheckResourceAttr("pve_vm.vm1", "cpu_flags.0", "+aes"),
+				),
+			},
+			{
+				Config: config("host"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "cpu_type", "host"),
+					resource.TestCheckResourceAttr("pve_vm.vm1", "cpu_flags.0", "+aes"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceVMNetwork(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-network"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+					network {
+						bridge = "vmbr0"
+					}
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "network.0.model", "virtio"),
+					resource.TestCheckResourceAttr("pve_vm.vm1", "network.0.mtu", "0"),
+				),
+			},
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-network"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+					network {
+						bridge = "vmbr0"
+						mtu = 1
+					}
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "network.0.mtu", "1"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceVMPool(t *testing.T) {
+	uptime := 0
+	config := func(pool string) string {
+		return fmt.Sprintf(`
+		resource "pve_vm" "vm1" {
+			name = "test-vm1-pool"
+			template_name = "debian-10.11.4-20220312"
+			target_node = "pve"
+			target_storage = "local"
+			pool = %q
+			cores = 1
+			memory = 512
+		}
+		`, pool)
+	}
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config("test-pool"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "pool", "test-pool"),
+					testAccCheckVMInPool("pve_vm.vm1", "test-pool"),
+					testAccCheckVMNotRestarted("pve_vm.vm1", &uptime),
+				),
+			},
+			{
+				// moved in place
+				Config: config("test-pool-2"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "pool", "test-pool-2"),
+					testAccCheckVMInPool("pve_vm.vm1", "test-pool-2"),
+					testAccCheckVMNotRestarted("pve_vm.vm1", &uptime),
+				),
+			},
+			{
+				Config:      config("test-pool-missing"),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`pool "test-pool-missing" doesn't exist`),
+			},
+		},
+	})
+}
+
+// testAccCheckVMInPool checks the vm shows up in members of pool
+func testAccCheckVMInPool(name, pool string) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		rs, ok := s.RootModule().Resources[name]
+		if !ok {
+			return fmt.Errorf("resource %s not found", name)
+		}
+
+		client, err := testAccClient()
+		if err != nil {
+			return err
+		}
+
+		info, err := client.GetPoolInfo(pool)
+		if err != nil {
+			return err
+		}
+		data, _ := info["data"].(map[string]interface{})
+		members, _ := data["members"].([]interface{})
+		for _, member := range members {
+			member, _ := member.(map[string]interface{})
+			if vmid, ok := member["vmid"].(float64); ok && strconv.Itoa(int(vmid)) == rs.Primary.ID {
+				return nil
+			}
+		}
+		return fmt.Errorf("vm %s is not a member of pool %s", rs.Primary.ID, pool)
+	}
+}
+
+// testAccCheckVMConfigKeys checks the vm config contains all of keys
+func testAccCheckVMConfigKeys(name string, keys ...string) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		rs, ok := s.RootModule().Resources[name]
+		if !ok {
+			return fmt.Errorf("resource %s not found", name)
+		}
+		vmid, err := strconv.Atoi(rs.Primary.ID)
+		if err != nil {
+			return err
+		}
+
+		client, err := testAccClient()
+		if err != nil {
+			return err
+		}
+
+		vmConfig, err := client.GetVmConfig(pxapi.NewVmRef(vmid))
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if _, ok := vmConfig[key]; !ok {
+				return fmt.Errorf("vm %d has no %s in config", vmid, key)
+			}
+		}
+		return nil
+	}
+}
+
+// testAccCheckVMConfigValue checks key in the config of the vm has value
+func testAccCheckVMConfigValue(name, key, value string) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		rs, ok := s.RootModule().Resources[name]
+		if !ok {
+			return fmt.Errorf("resource %s not found", name)
+		}
+		vmid, err := strconv.Atoi(rs.Primary.ID)
+		if err != nil {
+			return err
+		}
+
+		client, err := testAccClient()
+		if err != nil {
+			return err
+		}
+
+		vmConfig, err := client.GetVmConfig(pxapi.NewVmRef(vmid))
+		if err != nil {
+			return err
+		}
+		if got := fmt.Sprint(vmConfig[key]); got != value {
+			return fmt.Errorf("vm %d has %s %q in config; want %q", vmid, key, got, value)
+		}
+		return nil
+	}
+}
+
+// testAccCheckVMDiskStorage checks the volume of disk device of the vm is on storage
+func testAccCheckVMDiskStorage(name, device, storage string) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		rs, ok := s.RootModule().Resources[name]
+		if !ok {
+			return fmt.Errorf("resource %s not found", name)
+		}
+		vmid, err := strconv.Atoi(rs.Primary.ID)
+		if err != nil {
+			return err
+		}
+
+		client, err := testAccClient()
+		if err != nil {
+			return err
+		}
+
+		vmConfig, err := client.GetVmConfig(pxapi.NewVmRef(vmid))
+		if err != nil {
+			return err
+		}
+		value, _ := vmConfig[device].(string)
+		file, _ := parsePropertyList(value, "file").Get("file")
+		if got, _, _ := strings.Cut(file, ":"); got != storage {
+			return fmt.Errorf("vm %d has %s %q on storage %q; want %q", vmid, device, file, got, storage)
+		}
+		return nil
+	}
+}
+
+// testAccCheckVMStarts compares the number of qmstart tasks of vm with *starts plus increase, then
+// records the current number in *starts. An increase below 0 only records.
+func testAccCheckVMStarts(name string, starts *int, increase int) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		rs, ok := s.RootModule().Resources[name]
+		if !ok {
+			return fmt.Errorf("resource %s not found", name)
+		}
+		client, err := testAccClient()
+		if err != nil {
+			return err
+		}
+		var tasks map[string]interface{}
+		url := fmt.Sprintf("/nodes/%s/tasks?vmid=%s&typefilter=qmstart&limit=1000", rs.Primary.Attributes["target_node"], rs.Primary.ID)
+		if err := client.GetJsonRetryable(url, &tasks, 3); err != nil {
+			return err
+		}
+		data, _ := tasks["data"].([]interface{})
+		current := len(data)
+		if increase >= 0 && current != *starts+increase {
+			return fmt.Errorf("vm %s was started %d times, want %d", rs.Primary.ID, current-*starts, increase)
+		}
+		*starts = current
+		return nil
+	}
+}
+
+// testAccCheckVMCloudInitCurrent checks the cloud-init drive of vm has no changes of the config
+// pending, ie. it was regenerated since.
+func testAccCheckVMCloudInitCurrent(name string) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		rs, ok := s.RootModule().Resources[name]
+		if !ok {
+			return fmt.Errorf("resource %s not found", name)
+		}
+		client, err := testAccClient()
+		if err != nil {
+			return err
+		}
+		var resp map[string]interface{}
+		url := fmt.Sprintf("/nodes/%s/qemu/%s/cloudinit", rs.Primary.Attributes["node"], rs.Primary.ID)
+		if err := client.GetJsonRetryable(url, &resp, 3); err != nil {
+			return err
+		}
+		data, _ := resp["data"].([]interface{})
+		for _, item := range data {
+			item, _ := item.(map[string]interface{})
+			if _, ok := item["pending"]; ok {
+				return fmt.Errorf("vm %s has %v pending on its cloud-init drive", rs.Primary.ID, item["key"])
+			}
+		}
+		return nil
+	}
+}
+
+func testAccClient() (*pxapi.Client, error) {
+	client, err := pxapi.NewClient(strings.TrimRight(os.Getenv("PVE_ENDPOINT"), "/")+"/api2/json", nil, nil, "", 300)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Login(os.Getenv("PVE_USERNAME"), os.Getenv("PVE_PASSWORD"), ""); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
 func TestAccResourceVMUserData(t *testing.T) {
 	resource.UnitTest(t, resource.TestCase{
 		PreCheck:          func() { testAccPreCheck(t) },
@@ -132,6 +512,10 @@ func TestAccResourceVMSwitchTemplate(t *testing.T) {
 					}
 				}
 				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "source_template.0.name", "debian-10.11.4-20220312"),
+					resource.TestCheckResourceAttrSet("pve_vm.vm1", "source_template.0.vmid"),
+				),
 			},
 			// Upgrade to newer distro (no hardware change)
 			{
@@ -167,6 +551,10 @@ func TestAccResourceVMSwitchTemplate(t *testing.T) {
 					}
 				}
 				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "source_template.0.name", "debian-10.12.1-20220403"),
+					resource.TestCheckResourceAttrSet("pve_vm.vm1", "source_template.0.vmid"),
+				),
 			},
 			// Switch to other distro (hardware changed)
 			{
@@ -206,6 +594,83 @@ func TestAccResourceVMSwitchTemplate(t *testing.T) {
 	})
 }
 
+func TestAccResourceVMSwitchTemplateKeepMAC(t *testing.T) {
+	mac := ""
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-keep-mac"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+				}
+				`,
+				Check: testAccCheckVMStableMAC("pve_vm.vm1", "net0", &mac),
+			},
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-keep-mac"
+					template_name = "debian-10.12.1-20220403"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+				}
+				`,
+				Check: testAccCheckVMStableMAC("pve_vm.vm1", "net0", &mac),
+			},
+		},
+	})
+}
+
+// testAccCheckVMStableMAC records mac address of device on first call, then checks it stays the same
+func testAccCheckVMStableMAC(name, device string, mac *string) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		rs, ok := s.RootModule().Resources[name]
+		if !ok {
+			return fmt.Errorf("resource %s not found", name)
+		}
+		vmid, err := strconv.Atoi(rs.Primary.ID)
+		if err != nil {
+			return err
+		}
+
+		client, err := testAccClient()
+		if err != nil {
+			return err
+		}
+
+		vmConfig, err := client.GetVmConfig(pxapi.NewVmRef(vmid))
+		if err != nil {
+			return err
+		}
+		nic, _ := vmConfig[device].(string)
+		l := parsePropertyList(nic, "model")
+		current := ""
+		for _, model := range nicModels {
+			if v, ok := l.Get(model); ok {
+				current = v
+			}
+		}
+		if current == "" {
+			return fmt.Errorf("vm %d has no mac address on %s", vmid, device)
+		}
+		if *mac == "" {
+			*mac = current
+		} else if *mac != current {
+			return fmt.Errorf("mac address of %s changed from %s to %s", device, *mac, current)
+		}
+		return nil
+	}
+}
+
 func TestAccResourceVMWithDisks(t *testing.T) {
 	resource.UnitTest(t, resource.TestCase{
 		PreCheck:          func() { testAccPreCheck(t) },
@@ -365,6 +830,48 @@ func TestAccResourceVMWithDisks(t *testing.T) {
 	})
 }
 
+func TestAccResourceVMWithFourDisks(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-four-disks"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+
+					disk {
+						storage = "local"
+						size = 1
+					}
+					disk {
+						storage = "local"
+						size = 2
+					}
+					disk {
+						storage = "local"
+						size = 3
+					}
+					disk {
+						storage = "local"
+						size = 4
+					}
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "disk.#", "4"),
+					testAccCheckVMConfigKeys("pve_vm.vm1", "scsi1", "scsi2", "scsi3", "scsi4"),
+				),
+			},
+		},
+	})
+}
+
 func TestAccResourceVMName(t *testing.T) {
 	resource.UnitTest(t, resource.TestCase{
 		PreCheck:          func() { testAccPreCheck(t) },
@@ -405,6 +912,7 @@ func TestAccResourceVMName(t *testing.T) {
 }
 
 func TestAccResourceVMOnBoot(t *testing.T) {
+	var uptime int
 	resource.UnitTest(t, resource.TestCase{
 		PreCheck:          func() { testAccPreCheck(t) },
 		ProviderFactories: providerFactories,
@@ -424,6 +932,10 @@ func TestAccResourceVMOnBoot(t *testing.T) {
 					resource.TestCheckResourceAttr("pve_vm.vm1", "onboot", "false"),
 				),
 			},
+			{
+				RefreshState: true,
+				Check:        testAccCheckVMNotRestarted("pve_vm.vm1", &uptime),
+			},
 			{
 				Config: `
 				resource "pve_vm" "vm1" {
@@ -438,6 +950,7 @@ func TestAccResourceVMOnBoot(t *testing.T) {
 				`,
 				Check: resource.ComposeTestCheckFunc(
 					resource.TestCheckResourceAttr("pve_vm.vm1", "onboot", "true"),
+					testAccCheckVMNotRestarted("pve_vm.vm1", &uptime),
 				),
 			},
 			{
@@ -575,8 +1088,2530 @@ func TestExecuteCommandOnNode(t *testing.T) {
 
 	cmd := "date > /tmp/current-date.txt"
 
-	if err := executeCommandOnNode(session, node, cmd); err != nil {
+	if _, err := executeCommandOnNode(session, node, cmd); err != nil {
 		t.Error(err)
 		return
 	}
 }
+
+func TestNICWithOptions(t *testing.T) {
+	cases := []struct {
+		current string
+		nic     map[string]interface{}
+		want    string
+	}{
+		{
+			current: "virtio=AA:BB:CC:DD:EE:FF,bridge=vmbr0,firewall=1",
+			nic:     map[string]interface{}{"model": "virtio", "bridge": "vmbr1", "mtu": 9000, "queues": 4, "link_down": true, "rate": 12.5},
+			want:    "virtio=AA:BB:CC:DD:EE:FF,bridge=vmbr1,firewall=1,mtu=9000,queues=4,link_down=1,rate=12.5",
+		},
+		{
+			current: "virtio=AA:BB:CC:DD:EE:FF,bridge=vmbr0,mtu=1,rate=10",
+			nic:     map[string]interface{}{"model": "e1000", "bridge": "vmbr0", "mtu": 0, "queues": 0, "link_down": false, "rate": 0.0},
+			want:    "e1000=AA:BB:CC:DD:EE:FF,bridge=vmbr0",
+		},
+		{
+			current: "",
+			nic:     map[string]interface{}{"model": "virtio", "bridge": "vmbr0", "mtu": 1, "queues": 0, "link_down": false, "rate": 0.0},
+			want:    "model=virtio,bridge=vmbr0,mtu=1",
+		},
+	}
+
+	for _, c := range cases {
+		if got := nicWithOptions(c.current, c.nic); got != c.want {
+			t.Errorf("nicWithOptions(%q) = %q; want %q", c.current, got, c.want)
+		}
+	}
+}
+
+func TestAccResourceVMCIUpgrade(t *testing.T) {
+	var starts int
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-ciupgrade"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "ci_upgrade", "false"),
+					testAccCheckVMStarts("pve_vm.vm1", &starts, -1),
+				),
+			},
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-ciupgrade"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+					ci_upgrade = true
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "ci_upgrade", "true"),
+					testAccCheckVMCloudInitCurrent("pve_vm.vm1"),
+					testAccCheckVMStarts("pve_vm.vm1", &starts, 0),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceVMDescription(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-description"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+					description = <<-EOF
+					  managed by terraform
+					EOF
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "description", "managed by terraform"),
+				),
+			},
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-description"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "description", ""),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceVMResetTrigger(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-reset"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+					reset_trigger = "1"
+				}
+				`,
+			},
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-reset"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+					reset_trigger = "2"
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "status", "running"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceVMHotplugDisk(t *testing.T) {
+	config := func(disks int, step, check string) string {
+		return `
+		locals {
+			password = "secret0001"
+		}
+		resource "pve_vm" "vm1" {
+			name = "test-vm1-hotplug-disk"
+			template_name = "debian-10.11.4-20220312"
+			target_node = "pve"
+			target_storage = "local"
+			cores = 1
+			memory = 512
+			hotplug = ["network", "disk", "usb"]
+			user_data = <<-EOF
+			#cloud-config
+			password: ${local.password}
+			chpasswd:
+			  expire: false
+			EOF
+			` + strings.Repeat(`
+			disk {
+				storage = "local"
+				size = 8
+			}
+			`, disks) + `
+		}
+
+		resource "null_resource" "check" {
+			triggers = {
+				step = "` + step + `"
+			}
+			provisioner "remote-exec" {
+				inline = [` + check + `]
+				connection {
+					type     = "ssh"
+					user     = "debian"
+					password = local.password
+					host     = pve_vm.vm1.ipv4_address
+				}
+			}
+		}
+		`
+	}
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		ExternalProviders: map[string]resource.ExternalProvider{
+			"null": {
+				Source:            "hashicorp/null",
+				VersionConstraint: "3.1.1",
+			},
+		},
+		Steps: []resource.TestStep{
+			{
+				Config: config(0, "1", `"echo hotplug > /tmp/tf-pve-test.txt"`),
+			},
+			// the disk shows up in the guest without a restart, which would have wiped /tmp
+			{
+				Config: config(1, "2", `"[ -f /tmp/tf-pve-test.txt ]", "[ $(lsblk /dev/sdb -o SIZE -n -r) = 8G ]"`),
+			},
+		},
+	})
+}
+
+func TestAccResourceVMStatusPaused(t *testing.T) {
+	config := func(status string) string {
+		return `
+		resource "pve_vm" "vm1" {
+			name = "test-vm1-paused"
+			template_name = "debian-10.11.4-20220312"
+			target_node = "pve"
+			target_storage = "local"
+			cores = 1
+			memory = 512
+			status = "` + status + `"
+		}
+		`
+	}
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config("paused"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "status", "paused"),
+				),
+			},
+			{
+				Config: config("running"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "status", "running"),
+				),
+			},
+			{
+				Config: config("paused"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "status", "paused"),
+				),
+			},
+			{
+				Config: config("stopped"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "status", "stopped"),
+				),
+			},
+		},
+	})
+}
+
+func TestVMStateJSON(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceVM().Schema, map[string]interface{}{
+		"name":         "vm1",
+		"status":       "running",
+		"ipv4_address": "10.0.0.2",
+	})
+	d.Set("network_interfaces", []interface{}{
+		map[string]interface{}{"name": "lo", "mac": "00:00:00:00:00:00", "ip_addresses": []interface{}{"127.0.0.1"}},
+		map[string]interface{}{"name": "eth0", "mac": "AA:BB:CC:DD:EE:FF", "ip_addresses": []interface{}{"10.0.0.2", "fe80::1"}},
+	})
+	vmConfig := map[string]interface{}{
+		"scsi0": "local:100/vm-100-disk-0.qcow2,size=8G",
+		"ide2":  "local:100/vm-100-cloudinit.qcow2,media=cdrom",
+		"net0":  "virtio=AA:BB:CC:DD:EE:FF,bridge=vmbr0",
+		"cores": float64(1),
+	}
+
+	got, err := vmStateJSON(d, 100, "pve", vmConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"vmid":100,"name":"vm1","node":"pve","status":"running","ipv4_address":"10.0.0.2","ip_addresses":["10.0.0.2","fe80::1"],` +
+		`"disks":[{"device":"scsi0","file":"local:100/vm-100-disk-0.qcow2","size":"8G"}],` +
+		`"nics":[{"device":"net0","model":"virtio","mac":"AA:BB:CC:DD:EE:FF","bridge":"vmbr0"}]}`
+	if got != want {
+		t.Errorf("vmStateJSON() = %s; want %s", got, want)
+	}
+}
+
+func TestAccResourceVMACPI(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-acpi"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "acpi", "true"),
+				),
+			},
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-acpi"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+					acpi = false
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "acpi", "false"),
+				),
+			},
+			// without acpi the vm must be stopped rather than shutdown
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-acpi"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+					acpi = false
+					status = "stopped"
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "status", "stopped"),
+				),
+			},
+		},
+	})
+}
+
+func TestAgentWithOptions(t *testing.T) {
+	cases := []struct {
+		agent map[string]interface{}
+		want  string
+	}{
+		{
+			agent: map[string]interface{}{"enabled": true, "type": "virtio", "fstrim_cloned_disks": false, "freeze_fs_on_backup": true},
+			want:  "1",
+		},
+		{
+			agent: map[string]interface{}{"enabled": true, "type": "isa", "fstrim_cloned_disks": true, "freeze_fs_on_backup": false},
+			want:  "1,fstrim_cloned_disks=1,freeze-fs-on-backup=0,type=isa",
+		},
+		{
+			agent: map[string]interface{}{"enabled": false, "type": "virtio", "fstrim_cloned_disks": false, "freeze_fs_on_backup": true},
+			want:  "0",
+		},
+	}
+
+	for _, c := range cases {
+		got := agentWithOptions(c.agent)
+		if got != c.want {
+			t.Errorf("agentWithOptions(%v) = %q; want %q", c.agent, got, c.want)
+		}
+		if parsed := parseAgent(map[string]interface{}{"agent": got}).block(); !reflect.DeepEqual(parsed, c.agent) {
+			t.Errorf("parseAgent(%q) = %v; want %v", got, parsed, c.agent)
+		}
+	}
+}
+
+func TestParseAgent(t *testing.T) {
+	cases := []struct {
+		agent interface{}
+		want  agentConfig
+	}{
+		{agent: "1", want: agentConfig{Enabled: true, Type: "virtio", FreezeFSOnBackup: true}},
+		{agent: "enabled=1", want: agentConfig{Enabled: true, Type: "virtio", FreezeFSOnBackup: true}},
+		{agent: "0", want: agentConfig{Enabled: false, Type: "virtio", FreezeFSOnBackup: true}},
+		{agent: "1,type=virtio", want: agentConfig{Enabled: true, Type: "virtio", FreezeFSOnBackup: true}},
+		{agent: "enabled=1,type=isa,fstrim_cloned_disks=1,freeze-fs-on-backup=0", want: agentConfig{Enabled: true, Type: "isa", FstrimClonedDisks: true}},
+		{agent: float64(1), want: agentConfig{Enabled: true, Type: "virtio", FreezeFSOnBackup: true}},
+		{agent: nil, want: agentConfig{Enabled: false, Type: "virtio", FreezeFSOnBackup: true}},
+	}
+
+	for _, c := range cases {
+		vmConfig := map[string]interface{}{}
+		if c.agent != nil {
+			vmConfig["agent"] = c.agent
+		}
+		if got := parseAgent(vmConfig); got != c.want {
+			t.Errorf("parseAgent(%v) = %+v; want %+v", c.agent, got, c.want)
+		}
+	}
+}
+
+func TestAccResourceVMStableIP(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-stable-ip"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+					stable_ip = true
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttrSet("pve_vm.vm1", "ipv4_address"),
+				),
+			},
+			// refresh keeps the recorded address
+			{
+				RefreshState: true,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttrSet("pve_vm.vm1", "ipv4_address"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceVMNetboot(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-netboot"
+					netboot = true
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+
+					network {
+						bridge = "vmbr0"
+					}
+
+					disk {
+						storage = "local"
+						size = 8
+					}
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "status", "running"),
+					testAccCheckVMConfigKeys("pve_vm.vm1", "net0", "boot", "scsi1"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceVMNetbootValidation(t *testing.T) {
+	config := func(source string) string {
+		return fmt.Sprintf(`
+		resource "pve_vm" "vm1" {
+			name = "test-vm1-netboot-validation"
+			%s
+			target_node = "pve"
+			target_storage = "local"
+			cores = 1
+			memory = 512
+			timezone = "Europe/Berlin"
+
+			network {
+				bridge = "vmbr0"
+			}
+		}
+		`, source)
+	}
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				// an explicit false is the same as leaving netboot unset
+				Config:             config("template_name = \"debian-10.11.4-20220312\"\nnetboot = false"),
+				PlanOnly:           true,
+				ExpectNonEmptyPlan: true,
+			},
+			{
+				Config:      config("netboot = false"),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`exactly one of template_name, import_ovf or netboot = true must be set`),
+			},
+			{
+				Config:      config("template_name = \"debian-10.11.4-20220312\"\nnetboot = true"),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`exactly one of template_name, import_ovf or netboot = true must be set`),
+			},
+			{
+				Config:      config("netboot = true"),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`timezone can't be set with netboot`),
+			},
+		},
+	})
+}
+
+func TestAccResourceVMVCPUs(t *testing.T) {
+	config := func(vcpus int) string {
+		return fmt.Sprintf(`
+		resource "pve_vm" "vm1" {
+			name = "test-vm1-vcpus"
+			template_name = "debian-10.11.4-20220312"
+			target_node = "pve"
+			target_storage = "local"
+			cores = 4
+			vcpus = %d
+			memory = 512
+			hotplug = ["network", "disk", "usb", "cpu"]
+		}
+		`, vcpus)
+	}
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config(2),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "vcpus", "2"),
+				),
+			},
+			{
+				Config: config(3),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "vcpus", "3"),
+				),
+			},
+			{
+				Config:      config(8),
+				ExpectError: regexp.MustCompile(`vcpus 8 exceeds`),
+			},
+		},
+	})
+}
+
+func TestAccResourceVMLiveUpdateNoRestart(t *testing.T) {
+	uptime := 0
+	config := func(description, tags string, protection bool) string {
+		return fmt.Sprintf(`
+		resource "pve_vm" "vm1" {
+			name = "test-vm1-live-update"
+			template_name = "debian-10.11.4-20220312"
+			target_node = "pve"
+			target_storage = "local"
+			cores = 1
+			memory = 512
+			description = %q
+			tags = %s
+			protection = %t
+		}
+		`, description, tags, protection)
+	}
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config("first", `["web"]`, false),
+			},
+			{
+				RefreshState: true,
+				Check:        testAccCheckVMNotRestarted("pve_vm.vm1", &uptime),
+			},
+			{
+				Config: config("second", `["web"]`, false),
+				Check:  testAccCheckVMNotRestarted("pve_vm.vm1", &uptime),
+			},
+			{
+				// only tags
+				Config: config("second", `["web", "prod"]`, false),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "tags.#", "2"),
+					testAccCheckVMNotRestarted("pve_vm.vm1", &uptime),
+				),
+			},
+			{
+				// only protection
+				Config: config("second", `["web", "prod"]`, true),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "protection", "true"),
+					testAccCheckVMNotRestarted("pve_vm.vm1", &uptime),
+				),
+			},
+			{
+				// unprotected again so the vm can be destroyed
+				Config: config("second", `["web", "prod"]`, false),
+				Check:  testAccCheckVMNotRestarted("pve_vm.vm1", &uptime),
+			},
+		},
+	})
+}
+
+// testAccCheckVMNotRestarted checks uptime of the vm never goes back, which would mean it was restarted
+func testAccCheckVMNotRestarted(name string, uptime *int) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		rs, ok := s.RootModule().Resources[name]
+		if !ok {
+			return fmt.Errorf("resource %s not found", name)
+		}
+		// uptime is only refreshed by read, it's unset right after create
+		if rs.Primary.Attributes["uptime"] == "" {
+			return nil
+		}
+		current, err := strconv.Atoi(rs.Primary.Attributes["uptime"])
+		if err != nil {
+			return err
+		}
+		if current < *uptime {
+			return fmt.Errorf("uptime went back from %d to %d, the vm was restarted", *uptime, current)
+		}
+		*uptime = current
+		return nil
+	}
+}
+
+func TestAccResourceVMWaitForCloudInit(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-wait-cloud-init"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+					wait_for_cloud_init = true
+					user_data = <<-EOF
+					#cloud-config
+					runcmd:
+					  - echo done > /tmp/tf-pve-test.txt
+					EOF
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "cloud_init_status", "done"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceVMDiskImportFrom(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-import-from"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+
+					disk {
+						storage = "local"
+						import_from = "/var/lib/vz/images/test-image.qcow2"
+					}
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					testAccCheckVMConfigKeys("pve_vm.vm1", "scsi1"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceVMCIPasswordHash(t *testing.T) {
+	var starts int
+	config := func(hash string) string {
+		return fmt.Sprintf(`
+		resource "pve_vm" "vm1" {
+			name = "test-vm1-ci-password-hash"
+			template_name = "debian-10.11.4-20220312"
+			target_node = "pve"
+			target_storage = "local"
+			cores = 1
+			memory = 512
+			ci_password_hash = %q
+		}
+		`, hash)
+	}
+	// sha-512 crypt hashes, as printed by mkpasswd -m sha-512
+	hashes := []string{
+		"$6$saltsalt$LBqPHGUnUGTnsTfUIVzSkzVa1Sk2YXaZy9E24Mj3zs4MnmBx3WL.ZZEn/cqLfd7Ga1dpFhMSVqmwzYyrd8ZnX0",
+		"$6$pepperpepper$3oJk0fA0v3XqkYtUeOuQnQ8sYF1cV0HgU4bQ4zR2pX8cGfQmTq4WmS6m9xYbV1l0bQYtK2y1o7Rz5Jm9f4nJ0.",
+	}
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config(hashes[0]),
+				Check: resource.ComposeTestCheckFunc(
+					testAccCheckVMConfigKeys("pve_vm.vm1", "cipassword"),
+					testAccCheckVMStarts("pve_vm.vm1", &starts, -1),
+				),
+			},
+			{
+				// the guest only gets the new hash from a regenerated drive on boot
+				Config: config(hashes[1]),
+				Check: resource.ComposeTestCheckFunc(
+					testAccCheckVMConfigKeys("pve_vm.vm1", "cipassword"),
+					testAccCheckVMStarts("pve_vm.vm1", &starts, 1),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceVMDiskVolid(t *testing.T) {
+	// owned by a vm id no test vm gets, so destroying the test vms leaves it to pve to keep
+	volid := "local:9999/vm-9999-disk-0.qcow2"
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		CheckDestroy:      testAccCheckVolumeExists("pve", volid),
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-disk-volid"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+
+					disk {
+						volid = %[1]q
+						shared = true
+					}
+				}
+
+				resource "pve_vm" "vm2" {
+					name = "test-vm2-disk-volid"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+
+					disk {
+						volid = %[1]q
+						shared = true
+					}
+				}
+				`, volid),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "disk.0.volid", volid),
+					resource.TestCheckResourceAttr("pve_vm.vm2", "disk.0.volid", volid),
+					resource.TestCheckResourceAttr("pve_vm.vm1", "disk.0.shared", "true"),
+				),
+			},
+		},
+	})
+}
+
+// testAccCheckVolumeExists checks volume volid is still on its storage of node
+func testAccCheckVolumeExists(node, volid string) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		client, err := newAPIClient(os.Getenv("PVE_ENDPOINT"), apiCredentials{username: os.Getenv("PVE_USERNAME"), password: os.Getenv("PVE_PASSWORD")})
+		if err != nil {
+			return err
+		}
+		session, err := client.getSession()
+		if err != nil {
+			return err
+		}
+		storage, _, _ := strings.Cut(volid, ":")
+		var resp map[string]interface{}
+		if _, err := session.GetJSON(fmt.Sprintf("/nodes/%s/storage/%s/content/%s", node, storage, url.PathEscape(volid)), nil, nil, &resp); err != nil {
+			return fmt.Errorf("volume %s is gone: %s", volid, err)
+		}
+		return nil
+	}
+}
+
+func TestVolumeOwner(t *testing.T) {
+	cases := map[string]int{
+		"local:9999/vm-9999-disk-0.qcow2": 9999,
+		"local-lvm:vm-100-disk-1":         100,
+		"local:100/base-100-disk-0.raw":   100,
+		"nfs:shared/data.qcow2":           0,
+		"ceph:cluster-data":               0,
+	}
+
+	for volid, want := range cases {
+		if got := volumeOwner(volid); got != want {
+			t.Errorf("volumeOwner(%q) = %d; want %d", volid, got, want)
+		}
+	}
+}
+
+func TestSMBIOSWithUUID(t *testing.T) {
+	for _, smbios := range []string{"", "manufacturer=pve,serial=abc"} {
+		vmConfig := map[string]interface{}{}
+		if smbios != "" {
+			vmConfig["smbios1"] = smbios
+		}
+		got, err := smbiosWithUUID(vmConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := parsePropertyList(got, "")
+		if id, _ := l.Get("uuid"); id == "" {
+			t.Errorf("smbiosWithUUID(%q) = %q; want a uuid", smbios, got)
+		}
+		for _, k := range []string{"manufacturer", "serial"} {
+			want, _ := parsePropertyList(smbios, "").Get(k)
+			if v, _ := l.Get(k); v != want {
+				t.Errorf("smbiosWithUUID(%q) %s = %q; want %q", smbios, k, v, want)
+			}
+		}
+	}
+}
+
+func TestVGAWithOptions(t *testing.T) {
+	cases := []struct {
+		vga  map[string]interface{}
+		want string
+	}{
+		{vga: map[string]interface{}{"type": "std", "memory": 0}, want: "std"},
+		{vga: map[string]interface{}{"type": "std", "memory": 32}, want: "std,memory=32"},
+		{vga: map[string]interface{}{"type": "qxl2", "memory": 64}, want: "qxl2,memory=64"},
+	}
+
+	for _, c := range cases {
+		got := vgaWithOptions(c.vga)
+		if got != c.want {
+			t.Errorf("vgaWithOptions(%v) = %q; want %q", c.vga, got, c.want)
+		}
+		if parsed := parseVGA(map[string]interface{}{"vga": got}); !reflect.DeepEqual(parsed, c.vga) {
+			t.Errorf("parseVGA(%q) = %v; want %v", got, parsed, c.vga)
+		}
+	}
+	if parsed := parseVGA(map[string]interface{}{}); parsed["type"] != "std" || parsed["memory"] != 0 {
+		t.Errorf("parseVGA of absent vga = %v; want std without memory", parsed)
+	}
+}
+
+func TestAccResourceVMVGA(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-vga"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+
+					vga {
+						type = "std"
+						memory = 32
+					}
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "vga.0.type", "std"),
+					resource.TestCheckResourceAttr("pve_vm.vm1", "vga.0.memory", "32"),
+				),
+			},
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-vga"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+
+					vga {
+						type = "qxl"
+						memory = 64
+					}
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "vga.0.type", "qxl"),
+					resource.TestCheckResourceAttr("pve_vm.vm1", "vga.0.memory", "64"),
+				),
+			},
+		},
+	})
+}
+
+func TestValidateTimezone(t *testing.T) {
+	for _, name := range []string{"UTC", "Europe/Berlin", "America/Argentina/Buenos_Aires"} {
+		if _, errs := validateTimezone(name, "timezone"); len(errs) > 0 {
+			t.Errorf("validateTimezone(%q) = %v; want no error", name, errs)
+		}
+	}
+	for _, name := range []string{"", "Local", "Europe/Nowhere", "../etc/passwd"} {
+		if _, errs := validateTimezone(name, "timezone"); len(errs) == 0 {
+			t.Errorf("validateTimezone(%q) passed; want an error", name)
+		}
+	}
+}
+
+func TestAccResourceVMTimezone(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-timezone"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+					timezone = "Europe/Berlin"
+					user_data = <<-EOF
+					#cloud-config
+					packages:
+					  - curl
+					EOF
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					testAccCheckVMConfigKeys("pve_vm.vm1", "cicustom"),
+				),
+			},
+		},
+	})
+}
+
+func TestCloudInitDrive(t *testing.T) {
+	cases := []struct {
+		vmConfig map[string]interface{}
+		device   string
+		ok       bool
+	}{
+		{vmConfig: map[string]interface{}{"ide2": "local:100/vm-100-cloudinit.qcow2,media=cdrom"}, device: "ide2", ok: true},
+		{vmConfig: map[string]interface{}{"scsi0": "local-lvm:vm-100-disk-0,size=8G", "ide0": "local-lvm:vm-100-cloudinit,media=cdrom"}, device: "ide0", ok: true},
+		{vmConfig: map[string]interface{}{"ide2": "local:cloudinit"}, device: "ide2", ok: true},
+		{vmConfig: map[string]interface{}{"ide2": "none,media=cdrom", "scsi0": "local-lvm:vm-100-disk-0,size=8G"}, ok: false},
+		{vmConfig: map[string]interface{}{"cicustom": "user=local:snippets/vm-100-cloudinit-user-data"}, ok: false},
+	}
+
+	for _, c := range cases {
+		device, ok := cloudInitDrive(c.vmConfig)
+		if device != c.device || ok != c.ok {
+			t.Errorf("cloudInitDrive(%v) = %q, %v; want %q, %v", c.vmConfig, device, ok, c.device, c.ok)
+		}
+	}
+}
+
+func TestNICMAC(t *testing.T) {
+	cases := map[string]string{
+		"virtio=AA:BB:CC:DD:EE:FF,bridge=vmbr0":  "AA:BB:CC:DD:EE:FF",
+		"e1000=12:34:56:78:9A:BC,bridge=vmbr1":   "12:34:56:78:9A:BC",
+		"model=virtio,macaddr=AA:BB:CC:DD:EE:FF": "AA:BB:CC:DD:EE:FF",
+		"model=virtio,bridge=vmbr0":              "",
+	}
+
+	for value, want := range cases {
+		if got := nicMAC(value); got != want {
+			t.Errorf("nicMAC(%q) = %q; want %q", value, got, want)
+		}
+	}
+}
+
+func TestAccResourceVMHotplugNIC(t *testing.T) {
+	var uptime int
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-hotplug-nic"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+					hotplug = ["network", "disk"]
+
+					network {
+						bridge = "vmbr0"
+					}
+				}
+				`,
+			},
+			{
+				RefreshState: true,
+				Check:        testAccCheckVMNotRestarted("pve_vm.vm1", &uptime),
+			},
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-hotplug-nic"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+					hotplug = ["network", "disk"]
+
+					network {
+						bridge = "vmbr0"
+					}
+					network {
+						bridge = "vmbr0"
+					}
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					testAccCheckVMConfigKeys("pve_vm.vm1", "net0", "net1"),
+					testAccCheckVMNotRestarted("pve_vm.vm1", &uptime),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceVMNICWithoutHotplug(t *testing.T) {
+	var starts int
+	config := func(nics string) string {
+		return fmt.Sprintf(`
+		resource "pve_vm" "vm1" {
+			name = "test-vm1-nic-without-hotplug"
+			template_name = "debian-10.11.4-20220312"
+			target_node = "pve"
+			target_storage = "local"
+			cores = 1
+			memory = 512
+			hotplug = ["disk"]
+			%s
+		}
+		`, nics)
+	}
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config(`
+				network {
+					bridge = "vmbr0"
+				}
+				network {
+					bridge = "vmbr0"
+				}
+				`),
+				Check: testAccCheckVMStarts("pve_vm.vm1", &starts, -1),
+			},
+			{
+				// changing the model of one nic and removing the other only applies on restart
+				Config: config(`
+				network {
+					bridge = "vmbr0"
+					model = "e1000"
+				}
+				`),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "network.#", "1"),
+					resource.TestCheckResourceAttr("pve_vm.vm1", "network.0.model", "e1000"),
+					testAccCheckVMStarts("pve_vm.vm1", &starts, 1),
+				),
+			},
+		},
+	})
+}
+
+func TestCloneSize(t *testing.T) {
+	tplConfig := map[string]interface{}{
+		"scsi0":   "local:100/base-100-disk-0.qcow2,size=8G",
+		"scsi1":   "local-lvm:base-100-disk-1,size=512M",
+		"ide2":    "local:iso/debian.iso,media=cdrom,size=300M",
+		"net0":    "virtio=AA:BB:CC:DD:EE:FF,bridge=vmbr0",
+		"unused0": "local:100/vm-100-disk-2.qcow2",
+		"cores":   float64(2),
+	}
+	got, err := cloneSize(tplConfig)
+	if want := int64(8<<30 + 512<<20); err != nil || got != want {
+		t.Errorf("cloneSize = %d, %v; want %d", got, err, want)
+	}
+	if _, err := cloneSize(map[string]interface{}{"scsi0": "local:vm-100-disk-0,size=8X"}); err == nil {
+		t.Errorf("cloneSize of an invalid size passed; want an error")
+	}
+}
+
+func TestParseDiskSize(t *testing.T) {
+	cases := map[string]int64{
+		"8G":   8 << 30,
+		"512M": 512 << 20,
+		"1T":   1 << 40,
+		"1.5G": 3 << 29,
+		"4096": 4096,
+		"":     0,
+	}
+
+	for size, want := range cases {
+		got, err := parseDiskSize(size)
+		if err != nil || got != want {
+			t.Errorf("parseDiskSize(%q) = %d, %v; want %d", size, got, err, want)
+		}
+	}
+	if _, err := parseDiskSize("8X"); err == nil {
+		t.Errorf("parseDiskSize(%q) passed; want an error", "8X")
+	}
+}
+
+func TestRNGWithOptions(t *testing.T) {
+	cases := []struct {
+		rng  map[string]interface{}
+		want string
+	}{
+		{rng: map[string]interface{}{"source": "/dev/urandom", "max_bytes": 1024, "period": 1000}, want: "/dev/urandom"},
+		{rng: map[string]interface{}{"source": "/dev/hwrng", "max_bytes": 0, "period": 500}, want: "/dev/hwrng,max_bytes=0,period=500"},
+	}
+
+	for _, c := range cases {
+		got := rngWithOptions(c.rng)
+		if got != c.want {
+			t.Errorf("rngWithOptions(%v) = %q; want %q", c.rng, got, c.want)
+		}
+		if parsed, ok := parseRNG(map[string]interface{}{"rng0": got}); !ok || !reflect.DeepEqual(parsed, c.rng) {
+			t.Errorf("parseRNG(%q) = %v; want %v", got, parsed, c.rng)
+		}
+	}
+	if parsed, ok := parseRNG(map[string]interface{}{"rng0": "source=/dev/random,max_bytes=2048"}); !ok || parsed["source"] != "/dev/random" || parsed["max_bytes"] != 2048 || parsed["period"] != 1000 {
+		t.Errorf("parseRNG of pve written value = %v", parsed)
+	}
+	if _, ok := parseRNG(map[string]interface{}{}); ok {
+		t.Errorf("parseRNG of absent rng0 reported a device")
+	}
+}
+
+func TestAccResourceVMRNG(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-rng"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+
+					rng {
+						source = "/dev/urandom"
+						max_bytes = 2048
+					}
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					testAccCheckVMConfigKeys("pve_vm.vm1", "rng0"),
+					resource.TestCheckResourceAttr("pve_vm.vm1", "rng.0.max_bytes", "2048"),
+					resource.TestCheckResourceAttr("pve_vm.vm1", "rng.0.period", "1000"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceVMSingleRestart(t *testing.T) {
+	var starts int
+	config := func(cores, memory int, agentType string) string {
+		return fmt.Sprintf(`
+		resource "pve_vm" "vm1" {
+			name = "test-vm1-single-restart"
+			template_name = "debian-10.11.4-20220312"
+			target_node = "pve"
+			target_storage = "local"
+			cores = %d
+			memory = %d
+
+			agent {
+				type = %q
+			}
+		}
+		`, cores, memory, agentType)
+	}
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config(1, 512, "virtio"),
+				Check:  testAccCheckVMStarts("pve_vm.vm1", &starts, -1),
+			},
+			{
+				// cores, memory and agent each need a restart, they're applied by one
+				Config: config(2, 1024, "isa"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "cores", "2"),
+					resource.TestCheckResourceAttr("pve_vm.vm1", "memory", "1024"),
+					resource.TestCheckResourceAttr("pve_vm.vm1", "agent.0.type", "isa"),
+					testAccCheckVMStarts("pve_vm.vm1", &starts, 1),
+				),
+			},
+		},
+	})
+}
+
+func TestConfigIPv4(t *testing.T) {
+	cases := []struct {
+		ipconfig string
+		ip       string
+		ok       bool
+	}{
+		{ipconfig: "ip=10.0.0.5/24,gw=10.0.0.1", ip: "10.0.0.5", ok: true},
+		{ipconfig: "gw=192.168.1.1,ip=192.168.1.20/24", ip: "192.168.1.20", ok: true},
+		{ipconfig: "ip=dhcp", ok: false},
+		{ipconfig: "ip6=auto", ok: false},
+		{ipconfig: "", ok: false},
+	}
+
+	for _, c := range cases {
+		vmConfig := map[string]interface{}{}
+		if c.ipconfig != "" {
+			vmConfig["ipconfig0"] = c.ipconfig
+		}
+		if ip, ok := configIPv4(vmConfig); ip != c.ip || ok != c.ok {
+			t.Errorf("configIPv4(%q) = %q, %v; want %q, %v", c.ipconfig, ip, ok, c.ip, c.ok)
+		}
+	}
+}
+
+func TestAccResourceVMTemplateSwitchStrategy(t *testing.T) {
+	var firstID, secondID string
+	config := func(strategy, template string) string {
+		return fmt.Sprintf(`
+		resource "pve_vm" "vm1" {
+			name = "test-vm1-template-switch"
+			template_name = %q
+			template_switch_strategy = %q
+			target_node = "pve"
+			target_storage = "local"
+			cores = 1
+			memory = 512
+		}
+		`, template, strategy)
+	}
+	recordID := func(id *string) resource.TestCheckFunc {
+		return func(s *terraform.State) error {
+			*id = s.RootModule().Resources["pve_vm.vm1"].Primary.ID
+			return nil
+		}
+	}
+	changedID := func(previous *string) resource.TestCheckFunc {
+		return func(s *terraform.State) error {
+			if id := s.RootModule().Resources["pve_vm.vm1"].Primary.ID; id == *previous {
+				return fmt.Errorf("vm id stayed %s, want a new vm", id)
+			}
+			return nil
+		}
+	}
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config("blue_green", "debian-10.11.4-20220312"),
+				Check:  recordID(&firstID),
+			},
+			{
+				Config: config("blue_green", "debian-10.12.1-20220403"),
+				Check: resource.ComposeTestCheckFunc(
+					changedID(&firstID),
+					recordID(&secondID),
+					resource.TestCheckResourceAttr("pve_vm.vm1", "template_name", "debian-10.12.1-20220403"),
+				),
+			},
+			{
+				Config: config("recreate", "debian-10.11.4-20220312"),
+				Check: resource.ComposeTestCheckFunc(
+					changedID(&secondID),
+					resource.TestCheckResourceAttr("pve_vm.vm1", "template_name", "debian-10.11.4-20220312"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceVMLinkedClone(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-linked-clone"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+					full_clone = false
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "full_clone", "false"),
+					testAccCheckVMConfigKeys("pve_vm.vm1", "scsi0"),
+				),
+			},
+		},
+	})
+}
+
+func TestDiskDevices(t *testing.T) {
+	disks := []interface{}{
+		map[string]interface{}{"type": "scsi"},
+		map[string]interface{}{"type": "virtio"},
+		map[string]interface{}{"type": "scsi"},
+		map[string]interface{}{"type": "sata"},
+		map[string]interface{}{},
+	}
+	want := []string{"scsi1", "virtio1", "scsi2", "sata1", "scsi3"}
+	if got := diskDevices(disks); !reflect.DeepEqual(got, want) {
+		t.Errorf("diskDevices() = %v; want %v", got, want)
+	}
+}
+
+func TestAccResourceVMDiskTypeResize(t *testing.T) {
+	config := func(size int) string {
+		return fmt.Sprintf(`
+		resource "pve_vm" "vm1" {
+			name = "test-vm1-disk-type-resize"
+			template_name = "debian-10.11.4-20220312"
+			target_node = "pve"
+			target_storage = "local"
+			cores = 1
+			memory = 512
+
+			disk {
+				type = "virtio"
+				storage = "local"
+				size = %d
+			}
+		}
+		`, size)
+	}
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config(4),
+				Check: resource.ComposeTestCheckFunc(
+					testAccCheckVMConfigKeys("pve_vm.vm1", "virtio1"),
+					resource.TestCheckResourceAttr("pve_vm.vm1", "disk.0.size", "4"),
+				),
+			},
+			{
+				Config: config(6),
+				Check:  resource.TestCheckResourceAttr("pve_vm.vm1", "disk.0.size", "6"),
+			},
+			{
+				Config:      config(5),
+				ExpectError: regexp.MustCompile(`disk.0.size can't shrink`),
+			},
+		},
+	})
+}
+
+func TestVMMemory(t *testing.T) {
+	cases := []struct {
+		vmConfig map[string]interface{}
+		memory   int
+		balloon  int
+	}{
+		{vmConfig: map[string]interface{}{"memory": float64(2048)}, memory: 2048, balloon: 2048},
+		{vmConfig: map[string]interface{}{"memory": float64(2048), "balloon": float64(512)}, memory: 2048, balloon: 512},
+		{vmConfig: map[string]interface{}{"memory": float64(2048), "balloon": float64(0)}, memory: 2048, balloon: 0},
+	}
+
+	for _, c := range cases {
+		memory, balloon := vmMemory(c.vmConfig)
+		if memory != c.memory || balloon != c.balloon {
+			t.Errorf("vmMemory(%v) = %d, %d; want %d, %d", c.vmConfig, memory, balloon, c.memory, c.balloon)
+		}
+	}
+}
+
+func TestAccResourceVMBalloon(t *testing.T) {
+	config := func(balloon int) string {
+		return fmt.Sprintf(`
+		resource "pve_vm" "vm1" {
+			name = "test-vm1-balloon"
+			template_name = "debian-10.11.4-20220312"
+			target_node = "pve"
+			target_storage = "local"
+			cores = 1
+			memory = 1024
+			balloon = %d
+		}
+		`, balloon)
+	}
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config(512),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "memory", "1024"),
+					resource.TestCheckResourceAttr("pve_vm.vm1", "balloon", "512"),
+				),
+			},
+			{
+				// the balloon size of the running vm differs from the configured minimum,
+				// refreshing must not pick it up
+				Config:   config(512),
+				PlanOnly: true,
+			},
+			{
+				Config:      config(2048),
+				ExpectError: regexp.MustCompile(`balloon 2048 can't be more than memory 1024`),
+			},
+		},
+	})
+}
+
+func TestAccResourceVMUnknownBridge(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-bridge"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					network {
+						bridge = "vmbr0"
+					}
+					network {
+						bridge = "nosuchvnet"
+					}
+				}
+				`,
+				ExpectError: regexp.MustCompile(`network.1.bridge "nosuchvnet" is neither a bridge of node pve nor an SDN vnet`),
+			},
+		},
+	})
+}
+
+func TestWithoutHostname(t *testing.T) {
+	userData := "#cloud-config\nhostname: ws1-web\nmanage_etc_hosts: true\nfqdn: ws1-web.example.com\nuser: debian\n"
+	want := "#cloud-config\nmanage_etc_hosts: true\nuser: debian\n"
+	if got := withoutHostname(userData); got != want {
+		t.Errorf("withoutHostname(%q) = %q; want %q", userData, got, want)
+	}
+}
+
+func TestAccResourceVMHostname(t *testing.T) {
+	config := func(hostname string) string {
+		return fmt.Sprintf(`
+		resource "pve_vm" "vm1" {
+			name = "ws1-test-vm1-hostname"
+			template_name = "debian-10.11.4-20220312"
+			target_node = "pve"
+			target_storage = "local"
+			cores = 1
+			memory = 512
+			%s
+		}
+		`, hostname)
+	}
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config(""),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "hostname", "ws1-test-vm1-hostname"),
+				),
+			},
+			{
+				Config: config(`hostname = "test-vm1"`),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "hostname", "test-vm1"),
+					testAccCheckVMConfigKeys("pve_vm.vm1", "cicustom"),
+				),
+			},
+			{
+				Config:   config(`hostname = "test-vm1"`),
+				PlanOnly: true,
+			},
+		},
+	})
+}
+
+// testAccDeleteVM stops and deletes the vm behind the back of terraform, like removing it in the ui
+func testAccDeleteVM(name string) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		rs, ok := s.RootModule().Resources[name]
+		if !ok {
+			return fmt.Errorf("resource %s not found", name)
+		}
+		vmid, err := strconv.Atoi(rs.Primary.ID)
+		if err != nil {
+			return err
+		}
+		client, err := testAccClient()
+		if err != nil {
+			return err
+		}
+		vmref := pxapi.NewVmRef(vmid)
+		if err := client.CheckVmRef(vmref); err != nil {
+			return err
+		}
+		if _, err := client.StopVm(vmref); err != nil {
+			return err
+		}
+		_, err = client.DeleteVm(vmref)
+		return err
+	}
+}
+
+func TestAccResourceVMDeletedOutside(t *testing.T) {
+	config := `
+	resource "pve_vm" "vm1" {
+		name = "test-vm1-deleted-outside"
+		template_name = "debian-10.11.4-20220312"
+		target_node = "pve"
+		target_storage = "local"
+		cores = 1
+		memory = 512
+	}
+	`
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config:             config,
+				Check:              testAccDeleteVM("pve_vm.vm1"),
+				ExpectNonEmptyPlan: true,
+			},
+			{
+				// refresh drops the deleted vm, so apply creates it again
+				Config: config,
+				Check:  testAccCheckVMConfigKeys("pve_vm.vm1", "name"),
+			},
+		},
+	})
+}
+
+func TestAccResourceVMResumeCreate(t *testing.T) {
+	// a clone left behind by an interrupted create, like one killed right after cloning
+	var vmid int
+	preClone := func() {
+		client, err := testAccClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tplref, err := client.GetVmRefByName("debian-10.11.4-20220312")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vmid, err = client.GetNextID(0); err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.CloneQemuVm(tplref, map[string]interface{}{
+			"newid":       vmid,
+			"full":        true,
+			"name":        "test-vm1-resume",
+			"target":      tplref.Node(),
+			"description": withIncompleteMarker(""),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				PreConfig: preClone,
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-resume"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					func(s *terraform.State) error {
+						if id := s.RootModule().Resources["pve_vm.vm1"].Primary.ID; id != strconv.Itoa(vmid) {
+							return fmt.Errorf("vm %s was created instead of resuming vm %d", id, vmid)
+						}
+						return nil
+					},
+					resource.TestCheckResourceAttr("pve_vm.vm1", "description", ""),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceVMCloudInitDrive(t *testing.T) {
+	config := func(storage string) string {
+		return fmt.Sprintf(`
+		resource "pve_vm" "vm1" {
+			name = "test-vm1-cloud-init-drive"
+			template_name = "debian-10.11.4-20220312"
+			target_node = "pve"
+			target_storage = "local"
+			cores = 1
+			memory = 512
+			cloud_init_drive {
+				storage = "%s"
+				format = "qcow2"
+			}
+		}
+		`, storage)
+	}
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config:      config("local-lvm"),
+				ExpectError: regexp.MustCompile(`cloud_init_drive format qcow2 isn't supported by storage local-lvm of type lvmthin`),
+			},
+			{
+				Config: config("local"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "has_cloud_init", "true"),
+				),
+			},
+		},
+	})
+}
+
+func TestVMConfigToStateMissingKeys(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceVM().Schema, map[string]interface{}{
+		"name":   "vm1",
+		"memory": 1024,
+	})
+	vmConfig := map[string]interface{}{"digest": "0123456789abcdef"}
+	vmConfigToState(context.Background(), vmConfig, d)
+	if cores := d.Get("cores").(int); cores != 1 {
+		t.Errorf("cores = %d; want the pve default 1", cores)
+	}
+	if memory := d.Get("memory").(int); memory != 1024 {
+		t.Errorf("memory = %d; want 1024 kept from config", memory)
+	}
+	if name := d.Get("name").(string); name != "vm1" {
+		t.Errorf("name = %q; want vm1 kept from config", name)
+	}
+}
+
+func TestVMMeta(t *testing.T) {
+	cases := []struct {
+		vmConfig map[string]interface{}
+		meta     map[string]interface{}
+	}{
+		{
+			vmConfig: map[string]interface{}{"meta": "creation-qemu=6.1.0,ctime=1646894084"},
+			meta:     map[string]interface{}{"creation-qemu": "6.1.0", "ctime": "1646894084"},
+		},
+		{vmConfig: map[string]interface{}{}, meta: map[string]interface{}{}},
+	}
+
+	for _, c := range cases {
+		if meta := vmMeta(c.vmConfig); !reflect.DeepEqual(meta, c.meta) {
+			t.Errorf("vmMeta(%v) = %v; want %v", c.vmConfig, meta, c.meta)
+		}
+	}
+}
+
+func TestAccResourceVMLargeUserData(t *testing.T) {
+	// far beyond what fits a line of the node shell
+	userData := "#cloud-config\n" + strings.Repeat("# padding to make the snippet large\n", 4096) + "packages:\n  - curl\n"
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-large-user-data"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					snippet_storage = "local"
+					cores = 1
+					memory = 512
+					user_data = %q
+				}
+				`, userData),
+				Check: resource.ComposeTestCheckFunc(
+					testAccCheckVMConfigKeys("pve_vm.vm1", "cicustom"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceVMProtection(t *testing.T) {
+	config := func(autoClear bool) string {
+		return fmt.Sprintf(`
+		resource "pve_vm" "vm1" {
+			name = "test-vm1-protection"
+			template_name = "debian-10.11.4-20220312"
+			target_node = "pve"
+			target_storage = "local"
+			cores = 1
+			memory = 512
+			protection = true
+			auto_clear_protection = %t
+		}
+		`, autoClear)
+	}
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config(false),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "protection", "true"),
+					testAccCheckVMConfigKeys("pve_vm.vm1", "protection"),
+				),
+			},
+			{
+				Config:      config(false),
+				Destroy:     true,
+				ExpectError: regexp.MustCompile(`vm \d+ is protected`),
+			},
+			{
+				// destroyed at the end of the test with protection cleared
+				Config: config(true),
+			},
+		},
+	})
+}
+
+func TestAccResourceVMSnippetStorage(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-snippet-storage"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					snippet_storage = "local-lvm"
+					timezone = "UTC"
+				}
+				`,
+				ExpectError: regexp.MustCompile(`snippet_storage local-lvm doesn't allow snippets`),
+			},
+		},
+	})
+}
+
+func TestLeastLoadedNode(t *testing.T) {
+	cases := []struct {
+		counts    map[string]int
+		preferred string
+		node      string
+	}{
+		{counts: map[string]int{"pve1": 1, "pve2": 0, "pve3": 1}, preferred: "pve1", node: "pve2"},
+		{counts: map[string]int{"pve1": 1, "pve2": 1, "pve3": 1}, preferred: "pve3", node: "pve3"},
+		{counts: map[string]int{"pve1": 0, "pve2": 0}, preferred: "gone", node: "pve1"},
+	}
+
+	for _, c := range cases {
+		if node := leastLoadedNode(c.counts, c.preferred); node != c.node {
+			t.Errorf("leastLoadedNode(%v, %q) = %q; want %q", c.counts, c.preferred, node, c.node)
+		}
+	}
+}
+
+func TestAccResourceVMAntiAffinity(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+				resource "pve_vm" "vm" {
+					count = 2
+					name = "test-vm${count.index}-anti-affinity"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+					anti_affinity_group = "test"
+				}
+				`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttrSet("pve_vm.vm.0", "node"),
+					testAccCheckVMConfigKeys("pve_vm.vm.0", "tags"),
+					// a single node cluster hosts both, a larger one spreads them
+					func(s *terraform.State) error {
+						client, err := testAccClient()
+						if err != nil {
+							return err
+						}
+						nodes, err := client.GetNodeList()
+						if err != nil {
+							return err
+						}
+						node0 := s.RootModule().Resources["pve_vm.vm.0"].Primary.Attributes["node"]
+						node1 := s.RootModule().Resources["pve_vm.vm.1"].Primary.Attributes["node"]
+						if data, _ := nodes["data"].([]interface{}); len(data) > 1 && node0 == node1 {
+							return fmt.Errorf("both vms of the group were placed on node %s", node0)
+						}
+						return nil
+					},
+				),
+			},
+		},
+	})
+}
+
+func TestGlobalIPv6(t *testing.T) {
+	cases := []struct {
+		ips  []string
+		want string
+	}{
+		{ips: []string{"10.0.0.5", "fe80::1", "2001:db8::5"}, want: "2001:db8::5"},
+		{ips: []string{"::1", "fe80::be24:11ff:fe00:1"}, want: ""},
+		{ips: []string{"fd00::5", "2001:db8::5"}, want: "fd00::5"},
+		{ips: []string{}, want: ""},
+	}
+
+	for _, c := range cases {
+		ips := make([]net.IP, len(c.ips))
+		for i, ip := range c.ips {
+			ips[i] = net.ParseIP(ip)
+		}
+		if got := globalIPv6(ips); got != c.want {
+			t.Errorf("globalIPv6(%v) = %q; want %q", c.ips, got, c.want)
+		}
+	}
+}
+
+func TestAccResourceVMOSInfo(t *testing.T) {
+	config := `
+	resource "pve_vm" "vm1" {
+		name = "test-vm1-os-info"
+		template_name = "debian-10.11.4-20220312"
+		target_node = "pve"
+		target_storage = "local"
+		cores = 1
+		memory = 512
+
+		agent {
+			enabled = true
+		}
+	}
+	`
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config,
+			},
+			{
+				// read once the agent is up, which it is once ipv4_address was reported at create
+				RefreshState: true,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "os_info.0.id", "debian"),
+					resource.TestCheckResourceAttr("pve_vm.vm1", "os_info.0.version_id", "10"),
+				),
+			},
+		},
+	})
+}
+
+func TestPrimaryInterface(t *testing.T) {
+	ifaces := []pxapi.AgentNetworkInterface{
+		{Name: "lo", IPAddresses: []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")}},
+		{Name: "ens18", IPAddresses: []net.IP{net.ParseIP("169.254.3.4")}},
+		{Name: "ens19", IPAddresses: []net.IP{net.ParseIP("10.0.0.5"), net.ParseIP("fe80::1")}},
+	}
+	cases := map[string]string{
+		"":      "ens19",
+		"ens18": "ens18",
+		"eth0":  "",
+	}
+
+	for name, want := range cases {
+		got := ""
+		if iface := primaryInterface(ifaces, name); iface != nil {
+			got = iface.Name
+		}
+		if got != want {
+			t.Errorf("primaryInterface(%q) = %q; want %q", name, got, want)
+		}
+	}
+}
+
+func TestAccResourceVMACL(t *testing.T) {
+	config := func(role string) string {
+		return fmt.Sprintf(`
+		resource "pve_vm" "vm1" {
+			name = "test-vm1-acl"
+			template_name = "debian-10.11.4-20220312"
+			target_node = "pve"
+			target_storage = "local"
+			acl {
+				id = "root@pam"
+				role = %q
+			}
+		}
+		`, role)
+	}
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config("PVEAuditor"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "acl.#", "1"),
+					resource.TestCheckTypeSetElemNestedAttrs("pve_vm.vm1", "acl.*", map[string]string{"type": "user", "id": "root@pam", "role": "PVEAuditor"}),
+				),
+			},
+			{
+				Config: config("PVEVMUser"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "acl.#", "1"),
+					resource.TestCheckTypeSetElemNestedAttrs("pve_vm.vm1", "acl.*", map[string]string{"type": "user", "id": "root@pam", "role": "PVEVMUser"}),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceVMSockets(t *testing.T) {
+	config := func(sockets, vcpus int) string {
+		return fmt.Sprintf(`
+		resource "pve_vm" "vm1" {
+			name = "test-vm1-sockets"
+			template_name = "debian-10.11.4-20220312"
+			target_node = "pve"
+			target_storage = "local"
+			sockets = %d
+			cores = 2
+			vcpus = %d
+			memory = 512
+			hotplug = ["network", "disk", "usb", "cpu"]
+		}
+		`, sockets, vcpus)
+	}
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config(2, 3),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "sockets", "2"),
+					resource.TestCheckResourceAttr("pve_vm.vm1", "vcpus", "3"),
+					testAccCheckVMConfigKeys("pve_vm.vm1", "sockets", "vcpus"),
+				),
+			},
+			{
+				Config:      config(1, 3),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`vcpus 3 exceeds 1 sockets \* 2 cores`),
+			},
+		},
+	})
+}
+
+func TestValidateUserData(t *testing.T) {
+	cases := []struct {
+		userData string
+		warnings int
+		err      bool
+	}{
+		{userData: "#cloud-config\npassword: secret\nchpasswd:\n  expire: false\n"},
+		// expire indented wrong
+		{userData: "#cloud-config\npassword: secret\nchpasswd:\nexpire: false\n", warnings: 1},
+		{userData: "#cloud-config\npackages: [curl\n", err: true},
+		{userData: "#!/bin/sh\necho not yaml: [\n"},
+	}
+	for _, c := range cases {
+		ws, errs := validateUserData(c.userData, "user_data")
+		if len(ws) != c.warnings || (len(errs) > 0) != c.err {
+			t.Errorf("validateUserData(%q) = %v, %v; want %d warnings, error %v", c.userData, ws, errs, c.warnings, c.err)
+		}
+	}
+}
+
+func TestUserTags(t *testing.T) {
+	got := userTags(splitTags("anti-affinity.web;prod;terraform,web"), "terraform", "web")
+	want := []interface{}{"prod", "web"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("userTags() = %v; want %v", got, want)
+	}
+}
+
+func TestAccResourceVMTags(t *testing.T) {
+	uptime := 0
+	config := func(tags string) string {
+		return fmt.Sprintf(`
+		resource "pve_vm" "vm1" {
+			name = "test-vm1-tags"
+			template_name = "debian-10.11.4-20220312"
+			target_node = "pve"
+			target_storage = "local"
+			cores = 1
+			memory = 512
+			tags = %s
+		}
+		`, tags)
+	}
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config(`["web", "prod"]`),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "tags.#", "2"),
+					resource.TestCheckTypeSetElemAttr("pve_vm.vm1", "tags.*", "prod"),
+					testAccCheckVMNotRestarted("pve_vm.vm1", &uptime),
+				),
+			},
+			{
+				Config: config(`["web"]`),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "tags.#", "1"),
+					resource.TestCheckTypeSetElemAttr("pve_vm.vm1", "tags.*", "web"),
+					testAccCheckVMNotRestarted("pve_vm.vm1", &uptime),
+				),
+			},
+		},
+	})
+}
+
+// testAccStopVM stops the vm outside of terraform.
+func testAccStopVM(name string) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		rs, ok := s.RootModule().Resources[name]
+		if !ok {
+			return fmt.Errorf("resource %s not found", name)
+		}
+		vmid, err := strconv.Atoi(rs.Primary.ID)
+		if err != nil {
+			return err
+		}
+		client, err := testAccClient()
+		if err != nil {
+			return err
+		}
+		vmref := pxapi.NewVmRef(vmid)
+		if err := client.CheckVmRef(vmref); err != nil {
+			return err
+		}
+		_, err = client.StopVm(vmref)
+		return err
+	}
+}
+
+func TestAccResourceVMStatusDrift(t *testing.T) {
+	config := `
+	resource "pve_vm" "vm1" {
+		name = "test-vm1-status-drift"
+		template_name = "debian-10.11.4-20220312"
+		target_node = "pve"
+		target_storage = "local"
+		cores = 1
+		memory = 512
+		status = "running"
+	}
+	`
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config:             config,
+				Check:              testAccStopVM("pve_vm.vm1"),
+				ExpectNonEmptyPlan: true,
+			},
+			{
+				// started again
+				Config: config,
+				Check:  resource.TestCheckResourceAttr("pve_vm.vm1", "status", "running"),
+			},
+		},
+	})
+}
+
+// testAccCheckVMFile checks file in the guest has content, read through the guest agent.
+func testAccCheckVMFile(name, file, content string) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		rs, ok := s.RootModule().Resources[name]
+		if !ok {
+			return fmt.Errorf("resource %s not found", name)
+		}
+		vmid, err := strconv.Atoi(rs.Primary.ID)
+		if err != nil {
+			return err
+		}
+		client, err := newAPIClient(os.Getenv("PVE_ENDPOINT"), apiCredentials{username: os.Getenv("PVE_USERNAME"), password: os.Getenv("PVE_PASSWORD")})
+		if err != nil {
+			return err
+		}
+		got, err := client.agentFileRead(pxapi.NewVmRef(vmid), file)
+		if err != nil {
+			return err
+		}
+		if got != content {
+			return fmt.Errorf("%s in vm %d has %q, expected %q", file, vmid, got, content)
+		}
+		return nil
+	}
+}
+
+func TestAccResourceVMUserDataUpdate(t *testing.T) {
+	id := ""
+	config := func(message string) string {
+		return fmt.Sprintf(`
+		resource "pve_vm" "vm1" {
+			name = "test-vm1-user-data-update"
+			template_name = "debian-10.11.4-20220312"
+			target_node = "pve"
+			target_storage = "local"
+			cores = 1
+			memory = 512
+			wait_for_cloud_init = true
+			user_data = <<-EOF
+			#cloud-config
+			write_files:
+			  - path: /etc/tf-pve-test.txt
+			    content: %s
+			EOF
+		}
+		`, message)
+	}
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config("first"),
+				Check: resource.ComposeTestCheckFunc(
+					testAccCheckVMFile("pve_vm.vm1", "/etc/tf-pve-test.txt", "first"),
+					func(s *terraform.State) error {
+						id = s.RootModule().Resources["pve_vm.vm1"].Primary.ID
+						return nil
+					},
+				),
+			},
+			{
+				// updated in place, the guest gets the new user data after the restart
+				Config: config("second"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttrPtr("pve_vm.vm1", "id", &id),
+					testAccCheckVMFile("pve_vm.vm1", "/etc/tf-pve-test.txt", "second"),
+				),
+			},
+		},
+	})
+}
+
+func TestBalloonWarnings(t *testing.T) {
+	cases := []struct {
+		vmConfig              map[string]interface{}
+		balloonSet, sharesSet bool
+		warnings              int
+	}{
+		{vmConfig: map[string]interface{}{"memory": float64(2048), "balloon": float64(1024)}, balloonSet: true, sharesSet: true},
+		{vmConfig: map[string]interface{}{"memory": float64(2048), "balloon": float64(2048)}, balloonSet: true, sharesSet: true, warnings: 2},
+		// no balloon device
+		{vmConfig: map[string]interface{}{"memory": float64(2048), "balloon": float64(0)}, balloonSet: true, sharesSet: true, warnings: 1},
+		// balloon defaults to memory
+		{vmConfig: map[string]interface{}{"memory": float64(2048)}, sharesSet: true, warnings: 1},
+		{vmConfig: map[string]interface{}{"memory": float64(2048)}},
+	}
+	for _, c := range cases {
+		if diags := balloonWarnings(c.vmConfig, c.balloonSet, c.sharesSet); len(diags) != c.warnings {
+			t.Errorf("balloonWarnings(%v, %v, %v) = %v; want %d warnings", c.vmConfig, c.balloonSet, c.sharesSet, diags, c.warnings)
+		}
+	}
+}
+
+// testAccSetVMConfig changes the config of the vm outside of terraform.
+func testAccSetVMConfig(name string, params map[string]interface{}) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		rs, ok := s.RootModule().Resources[name]
+		if !ok {
+			return fmt.Errorf("resource %s not found", name)
+		}
+		vmid, err := strconv.Atoi(rs.Primary.ID)
+		if err != nil {
+			return err
+		}
+		client, err := testAccClient()
+		if err != nil {
+			return err
+		}
+		vmref := pxapi.NewVmRef(vmid)
+		if err := client.CheckVmRef(vmref); err != nil {
+			return err
+		}
+		_, err = client.SetVmConfig(vmref, params)
+		return err
+	}
+}
+
+func TestAccResourceVMCICustomDrift(t *testing.T) {
+	config := `
+	resource "pve_vm" "vm1" {
+		name = "test-vm1-cicustom-drift"
+		template_name = "debian-10.11.4-20220312"
+		target_node = "pve"
+		target_storage = "local"
+		cores = 1
+		memory = 512
+		timezone = "UTC"
+	}
+	`
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestMatchResourceAttr("pve_vm.vm1", "cicustom", regexp.MustCompile(`^vendor=local:snippets/vm-\d+-cloudinit-vendor-data$`)),
+					testAccSetVMConfig("pve_vm.vm1", map[string]interface{}{"cicustom": "vendor=local:snippets/other-vendor-data"}),
+				),
+				ExpectNonEmptyPlan: true,
+			},
+			{
+				// restored
+				Config: config,
+				Check:  resource.TestMatchResourceAttr("pve_vm.vm1", "cicustom", regexp.MustCompile(`^vendor=local:snippets/vm-\d+-cloudinit-vendor-data$`)),
+			},
+		},
+	})
+}
+
+func TestAccResourceVMTimeouts(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-timeouts"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+
+					timeouts {
+						create = "5s"
+					}
+				}
+				`,
+				ExpectError: regexp.MustCompile(`(?i)timeout|deadline exceeded`),
+			},
+			{
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-timeouts"
+					template_name = "debian-10.11.4-20220312"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+
+					timeouts {
+						create = "30m"
+						update = "30m"
+						delete = "30m"
+					}
+				}
+				`,
+				Check: resource.TestCheckResourceAttrSet("pve_vm.vm1", "ipv4_address"),
+			},
+		},
+	})
+}
+
+func TestHostPCIWithOptions(t *testing.T) {
+	cases := []struct {
+		dev  map[string]interface{}
+		want string
+	}{
+		{dev: map[string]interface{}{"host": "0000:01:00.0", "mdev": "", "pcie": false, "rombar": true}, want: "0000:01:00.0"},
+		{dev: map[string]interface{}{"host": "0000:00:02.0", "mdev": "i915-GVTg_V5_4", "pcie": true, "rombar": false}, want: "0000:00:02.0,mdev=i915-GVTg_V5_4,pcie=1,rombar=0"},
+	}
+
+	for i, c := range cases {
+		got := hostPCIWithOptions(c.dev)
+		if got != c.want {
+			t.Errorf("hostPCIWithOptions(%v) = %q; want %q", c.dev, got, c.want)
+		}
+		key := fmt.Sprintf("hostpci%d", i)
+		if parsed := parseHostPCI(map[string]interface{}{key: got}); len(parsed) != 1 || !reflect.DeepEqual(parsed[0], c.dev) {
+			t.Errorf("parseHostPCI(%q) = %v; want %v", got, parsed, c.dev)
+		}
+	}
+	parsed := parseHostPCI(map[string]interface{}{"hostpci1": "host=01:00,mdev=nvidia-35", "hostpci0": "0000:02:00.0,x-vga=1"})
+	if len(parsed) != 2 || parsed[0].(map[string]interface{})["host"] != "0000:02:00.0" || parsed[1].(map[string]interface{})["mdev"] != "nvidia-35" {
+		t.Errorf("parseHostPCI of pve written values = %v", parsed)
+	}
+}
+
+func TestAccResourceVMOSDiskStorage(t *testing.T) {
+	config := func(storage string) string {
+		return fmt.Sprintf(`
+		resource "pve_vm" "vm1" {
+			name = "test-vm1-os-disk-storage"
+			template_name = "debian-10.11.4-20220312"
+			target_node = "pve"
+			target_storage = "%s"
+			cores = 1
+			memory = 512
+		}
+		`, storage)
+	}
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config("local-lvm"),
+				Check: resource.ComposeTestCheckFunc(
+					testAccCheckVMDiskStorage("pve_vm.vm1", "scsi0", "local-lvm"),
+				),
+			},
+			{
+				Config: config("local"),
+				Check: resource.ComposeTestCheckFunc(
+					testAccCheckVMDiskStorage("pve_vm.vm1", "scsi0", "local"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceVMDiskStorage(t *testing.T) {
+	config := func(storage string) string {
+		return fmt.Sprintf(`
+		resource "pve_vm" "vm1" {
+			name = "test-vm1-disk-storage"
+			template_name = "debian-10.11.4-20220312"
+			target_node = "pve"
+			target_storage = "local"
+			cores = 1
+			memory = 512
+
+			disk {
+				size = 1
+			}
+			disk {
+				storage = "%s"
+				size = 2
+			}
+		}
+		`, storage)
+	}
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config("local-lvm"),
+				Check: resource.ComposeTestCheckFunc(
+					testAccCheckVMConfigKeys("pve_vm.vm1", "scsi1", "scsi2"),
+					resource.TestCheckResourceAttr("pve_vm.vm1", "disk.0.storage", "local"),
+					resource.TestCheckResourceAttr("pve_vm.vm1", "disk.1.storage", "local-lvm"),
+				),
+			},
+			{
+				// moved
+				Config: config("local"),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "disk.1.storage", "local"),
+					resource.TestCheckResourceAttr("pve_vm.vm1", "disk.1.size", "2"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccResourceVMHotplugDisable(t *testing.T) {
+	config := func(hotplug string) string {
+		return fmt.Sprintf(`
+		resource "pve_vm" "vm1" {
+			name = "test-vm1-hotplug-disable"
+			template_name = "debian-10.11.4-20220312"
+			target_node = "pve"
+			target_storage = "local"
+			cores = 1
+			memory = 512
+			hotplug = %s
+		}
+		`, hotplug)
+	}
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config(`["network", "disk"]`),
+				Check:  testAccCheckVMConfigValue("pve_vm.vm1", "hotplug", "disk,network"),
+			},
+			{
+				Config: config(`[]`),
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr("pve_vm.vm1", "hotplug.#", "0"),
+					testAccCheckVMConfigValue("pve_vm.vm1", "hotplug", "0"),
+				),
+			},
+		},
+	})
+}
+
+func TestShellQuote(t *testing.T) {
+	cases := map[string]string{
+		"/root/vm.ovf":          `'/root/vm.ovf'`,
+		"local-lvm":             `'local-lvm'`,
+		"/tmp/it's.ovf":         `'/tmp/it'\''s.ovf'`,
+		"/tmp/$(id)`id`\\$HOME": `'/tmp/$(id)` + "`id`" + `\$HOME'`,
+	}
+
+	for in, want := range cases {
+		got := shellQuote(in)
+		if got != want {
+			t.Errorf("shellQuote(%q) = %s; want %s", in, got, want)
+		}
+		// the shell gets back the word as it was
+		if sh, err := exec.LookPath("sh"); err == nil {
+			out, err := exec.Command(sh, "-c", "printf %s "+got).Output()
+			if err != nil || string(out) != in {
+				t.Errorf("sh printed %q for %s, %v; want %q", out, got, err, in)
+			}
+		}
+	}
+}
+
+func TestAccResourceVMImportOVFQuoting(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		PreCheck:          func() { testAccPreCheck(t) },
+		ProviderFactories: providerFactories,
+		Steps: []resource.TestStep{
+			{
+				// the command substitution is part of the path, not run by the node shell
+				Config: `
+				resource "pve_vm" "vm1" {
+					name = "test-vm1-import-ovf"
+					import_ovf = "/tmp/$(touch /tmp/tf-pve-test-injected).ovf"
+					target_node = "pve"
+					target_storage = "local"
+					cores = 1
+					memory = 512
+				}
+				`,
+				ExpectError: regexp.MustCompile(`ovf manifest /tmp/\$\(touch /tmp/tf-pve-test-injected\)\.ovf is not readable`),
+			},
+		},
+	})
+}